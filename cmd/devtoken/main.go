@@ -0,0 +1,162 @@
+// Выпуск JWT для локальной проверки без внешнего провайдера
+// При первом запуске создает ключ и JWKS для JWT_JWKS, затем печатает подписанный токен
+//
+//	go run ./cmd/devtoken -sub alice -scope "uploads:read uploads:write"
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func main() {
+	keyPath := flag.String("key", "jwt-dev-key.pem", "private key (PKCS#8 PEM), created if missing")
+	jwksPath := flag.String("jwks", "jwt-dev-jwks.json", "JWKS with the public key, rewritten on every run")
+	alg := flag.String("alg", "ES256", "algorithm for a new key: ES256 or RS256")
+	kid := flag.String("kid", "dev", "key id")
+	sub := flag.String("sub", "dev", "owner (sub claim)")
+	scope := flag.String("scope", "uploads:read uploads:write", "space separated scopes")
+	tenant := flag.String("tenant", "", "tenant (tenant claim), empty - default tenant")
+	iss := flag.String("iss", "", "issuer (iss claim)")
+	aud := flag.String("aud", "", "audience (aud claim)")
+	ttl := flag.Duration("ttl", time.Hour, "token lifetime")
+	flag.Parse()
+
+	key, err := loadOrCreateKey(*keyPath, *alg)
+	if err != nil {
+		fail(err)
+	}
+	if err = writeJWKS(*jwksPath, *kid, key.Public()); err != nil {
+		fail(err)
+	}
+
+	method := jwt.SigningMethod(jwt.SigningMethodES256)
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		method = jwt.SigningMethodRS256
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub":   *sub,
+		"scope": *scope,
+		"iat":   now.Unix(),
+		"exp":   now.Add(*ttl).Unix(),
+	}
+	if *tenant != "" {
+		claims["tenant"] = *tenant
+	}
+	if *iss != "" {
+		claims["iss"] = *iss
+	}
+	if *aud != "" {
+		claims["aud"] = *aud
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = *kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(signed)
+}
+
+// Читаем ключ или создаем новый
+func loadOrCreateKey(path string, alg string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM block", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+		}
+		return signer, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	switch alg {
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "created %s key %s\n", alg, path)
+
+	return key, nil
+}
+
+// Пишем JWKS с открытым ключом
+func writeJWKS(path string, kid string, public crypto.PublicKey) error {
+	jwk := map[string]string{"kid": kid, "use": "sig"}
+	switch public := public.(type) {
+	case *ecdsa.PublicKey:
+		jwk["kty"], jwk["crv"], jwk["alg"] = "EC", "P-256", "ES256"
+		jwk["x"] = encodeBigInt(public.X, 32)
+		jwk["y"] = encodeBigInt(public.Y, 32)
+	case *rsa.PublicKey:
+		jwk["kty"], jwk["alg"] = "RSA", "RS256"
+		jwk["n"] = encodeBigInt(public.N, 0)
+		jwk["e"] = encodeBigInt(big.NewInt(int64(public.E)), 0)
+	default:
+		return fmt.Errorf("unsupported public key %T", public)
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{"keys": []interface{}{jwk}}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+// Число в base64url, size > 0 дополняет нулями слева до нужной длины
+func encodeBigInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
-	"os"
-	"os/signal"
-	"sync"
-	"syscall"
+	"fmt"
 	"time"
 
 	"github.com/Yury132/Golang-Task-2/internal/config"
+	"github.com/Yury132/Golang-Task-2/internal/imaging"
+	"github.com/Yury132/Golang-Task-2/internal/lifecycle"
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/Yury132/Golang-Task-2/internal/ratelimit"
+	authService "github.com/Yury132/Golang-Task-2/internal/service/auth_service"
+	dlqService "github.com/Yury132/Golang-Task-2/internal/service/dlq_service"
+	eventsService "github.com/Yury132/Golang-Task-2/internal/service/events_service"
 	service "github.com/Yury132/Golang-Task-2/internal/service/main_service"
 	mediaService "github.com/Yury132/Golang-Task-2/internal/service/media_service"
+	outboxService "github.com/Yury132/Golang-Task-2/internal/service/outbox_service"
+	purgeService "github.com/Yury132/Golang-Task-2/internal/service/purge_service"
+	webhookService "github.com/Yury132/Golang-Task-2/internal/service/webhook_service"
 	objectStorage "github.com/Yury132/Golang-Task-2/internal/storage/object-storage"
 	"github.com/Yury132/Golang-Task-2/internal/storage/postgres"
 	transport "github.com/Yury132/Golang-Task-2/internal/transport/http"
@@ -21,6 +28,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/pressly/goose/v3"
+	"github.com/rs/zerolog"
 )
 
 // Для гуся
@@ -72,15 +80,14 @@ func main() {
 	}
 
 	// Подключение к Nats
-	nc, err := nats.Connect(cfg.NATS.URL)
+	// Канал закроется, когда Drain отправит все сообщения и закроет соединение
+	natsClosed := make(chan struct{})
+	nc, err := nats.Connect(cfg.NATS.URL, nats.ClosedHandler(func(_ *nats.Conn) {
+		close(natsClosed)
+	}))
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to connect to NATS")
 	}
-	defer func() {
-		if err = nc.Drain(); err != nil {
-			logger.Fatal().Err(err).Msg("failed to drain nats connection")
-		}
-	}()
 
 	// Создаем jetstream
 	js, err := jetstream.New(nc)
@@ -88,68 +95,205 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to create new jetstream")
 	}
 
+	// События media.events.> идут мимо JetStream, поэтому в поток попадают только задачи
+	// media.picture оставлен для задач, отправленных до появления арендаторов
 	streamCfg := jetstream.StreamConfig{
 		Name:      "EVENTS",
 		Retention: jetstream.WorkQueuePolicy,
-		Subjects:  []string{"media.>"},
+		Subjects:  []string{models.SubjectPictureLegacy, models.SubjectPictureAll, models.SubjectDeadLetterAll},
 	}
 
-	// Создаем поток
-	stream, err := js.CreateStream(ctx, streamCfg)
+	// Создаем поток или обновляем темы у существующего
+	stream, err := js.CreateOrUpdateStream(ctx, streamCfg)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to create new stream")
 	}
 
 	// Создаем получателя
 	cons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Name: "media_service",
+		Name:           "media_service",
+		FilterSubjects: []string{models.SubjectPictureLegacy, models.SubjectPictureAll},
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        cfg.Worker.AckWait,
+		MaxDeliver:     cfg.Worker.MaxDeliver,
+		BackOff:        cfg.Worker.BackOff,
 	})
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to create new consumer")
 	}
 
+	// Получатель недоставленных задач
+	dlqCons, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Name:          "dead_letters",
+		FilterSubject: models.SubjectDeadLetterAll,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to create dead letter consumer")
+	}
+
+	// Обработка изображений
+	processor, err := imaging.New(cfg.Imaging.Backend)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to init image processor")
+	}
+
+	// Пресеты миниатюр
+	presets, err := cfg.ThumbnailPresets()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid thumbnail presets")
+	}
+	for _, preset := range presets {
+		if !processor.Supports(preset.Format) {
+			logger.Fatal().Msgf("thumbnail preset %q: format %q is not supported by %q backend", preset.Name, preset.Format, cfg.Imaging.Backend)
+		}
+	}
+
 	// БД
 	strg := postgres.New(conn)
 	// Хранилище
-	objStorage := objectStorage.New(logger)
+	objStorage, err := newObjectStorage(ctx, cfg, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to init object storage")
+	}
+	// Отправка задач из outbox в Nats
+	relay := outboxService.New(logger, strg, js, cfg.Outbox.PollInterval, cfg.Outbox.BatchSize)
+	relay.Start()
 	// Главный сервис (загрузка изображений, получения данных)
-	svc := service.New(logger, strg, objStorage, js)
+	svc := service.New(logger, strg, objStorage, relay, presets, processor, cfg.Similarity.MaxDistance, cfg.Purge.Window, cfg.QuotaPolicy())
 	// Сервис создания миниатюр
-	mediaSvc := mediaService.New(logger, strg, objStorage, cons)
+	mediaSvc := mediaService.New(logger, strg, objStorage, cons, js, nc, nc, processor, cfg.Worker.MaxDeliver, cfg.Worker.BackOff)
+	// Сервис недоставленных задач
+	dlqSvc := dlqService.New(logger, strg, js, dlqCons)
+	if err = dlqSvc.Start(); err != nil {
+		logger.Fatal().Err(err).Msg("failed to start dead letter service")
+	}
+	// Окончательное удаление загрузок после окна восстановления
+	purger := purgeService.New(logger, strg, objStorage, cfg.Purge.Window, cfg.Purge.Interval, cfg.Purge.BatchSize)
+	purger.Start()
+	// События о миниатюрах для подписчиков SSE
+	eventsSvc := eventsService.New(logger, nc)
+	if err = eventsSvc.Start(); err != nil {
+		logger.Fatal().Err(err).Msg("failed to start event service")
+	}
+	// Доставка вебхуков с повторами
+	webhookSvc := webhookService.New(logger, strg, webhookService.Config{
+		PollInterval: cfg.Webhook.PollInterval,
+		BatchSize:    cfg.Webhook.BatchSize,
+		Timeout:      cfg.Webhook.Timeout,
+		MaxAttempts:  cfg.Webhook.MaxAttempts,
+		BaseBackoff:  cfg.Webhook.BaseBackoff,
+		MaxBackoff:   cfg.Webhook.MaxBackoff,
+		AllowPrivate: cfg.Webhook.AllowPrivate,
+	})
+	webhookSvc.Start()
+	// Проверка JWT внешнего провайдера, если задан JWKS
+	var tokens authService.TokenVerifier
+	if cfg.JWT.JWKS != "" {
+		tokens, err = authService.NewJWTVerifier(logger, authService.JWTConfig{
+			JWKS:        cfg.JWT.JWKS,
+			Issuer:      cfg.JWT.Issuer,
+			Audience:    cfg.JWT.Audience,
+			OwnerClaim:  cfg.JWT.OwnerClaim,
+			ScopeClaim:  cfg.JWT.ScopeClaim,
+			TenantClaim: cfg.JWT.TenantClaim,
+			Leeway:      cfg.JWT.Leeway,
+			Refresh:     cfg.JWT.Refresh,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load jwks")
+		}
+	}
+	// Проверка API ключей и JWT
+	authSvc := authService.New(logger, strg, tokens, cfg.Auth.AdminKey, cfg.Auth.AdminTenant, cfg.Auth.AdminOwner)
 	// Хэндлеры
-	handler := handlers.New(logger, svc)
+	// Ограничение частоты загрузок
+	var limiter handlers.RateLimiter
+	if cfg.RateLimit.UploadRate > 0 {
+		limiter = ratelimit.New(cfg.RateLimit.UploadRate, cfg.RateLimit.UploadBurst)
+	}
+	handler := handlers.New(logger, svc, dlqSvc, eventsSvc, webhookSvc, authSvc, handlers.UploadLimits{
+		MaxSize:       cfg.Server.MaxUploadSize,
+		Limiter:       limiter,
+		MaxConcurrent: cfg.RateLimit.MaxConcurrentUploads,
+		ReadTimeout:   cfg.RateLimit.UploadReadTimeout,
+	})
 	// Сервер
 	server := transport.New(":8080").WithHandler(handler)
 	// Управляем воркер пулом
-	wp := worker.New(logger, mediaSvc, 5)
-	wp.Start()
-
-	// Фиксируем нажатие Ctrl+C для остановки программы
-	shutdown := make(chan os.Signal, 1)
-	// Оповещаем канал
-	signal.Notify(shutdown, syscall.SIGINT)
+	wp := worker.New(logger, mediaSvc, cfg.Worker.Count, cfg.Worker.BatchSize, cfg.Worker.MaxInFlight, cfg.Worker.AckWait)
+	if err = wp.Start(); err != nil {
+		logger.Fatal().Err(err).Msg("failed to start workers")
+	}
 
 	// Запускаем сервер
 	go func() {
 		logger.Info().Msg("Server starting...")
-		if err = server.Run(); err != nil {
+		if err := server.Run(); err != nil {
 			logger.Fatal().Err(err).Msg("failed to start server")
 		}
 	}()
 
-	// Ждем нажатия Ctrl+C
-	<-shutdown
-
-	// Когда нажали Ctrl+C останавливаем всех воркеров
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
+	// Порядок остановки: сначала перестаем принимать запросы,
+	// затем доделываем миниатюры, и только потом закрываем Nats и БД
+	app := lifecycle.New(logger, cfg.Server.ShutdownTimeout)
+	// Потоки SSE не завершаются сами, закрываем их до остановки сервера
+	app.Add("event streams", func(_ context.Context) error {
+		eventsSvc.Stop()
+		return nil
+	})
+	app.Add("http server", server.Shutdown)
+	app.Add("workers", wp.Shutdown)
+	app.Add("dead letters", func(_ context.Context) error {
+		dlqSvc.Stop()
+		return nil
+	})
+	app.Add("purge", purger.Stop)
+	app.Add("webhooks", webhookSvc.Stop)
+	app.Add("outbox relay", relay.Stop)
+	app.Add("nats", func(ctx context.Context) error {
+		if err := nc.Drain(); err != nil {
+			return err
+		}
+		select {
+		case <-natsClosed:
+			return nil
+		case <-ctx.Done():
+			nc.Close()
+			return ctx.Err()
+		}
+	})
+	app.Add("image processor", func(_ context.Context) error {
+		processor.Shutdown()
+		return nil
+	})
+	app.Add("postgres", func(_ context.Context) error {
+		conn.Close()
+		return nil
+	})
 
-	go func() {
-		// Останавливаем всех воркеров
-		wp.Shutdown()
+	// Ждем Ctrl+C или SIGTERM
+	app.Wait()
+}
 
-		defer wg.Done()
-	}()
-	// Ждем пока остановятся все воркеры
-	wg.Wait()
+// Хранилище изображений по настройкам
+func newObjectStorage(ctx context.Context, cfg *config.Config, logger zerolog.Logger) (objectStorage.ObjectStorage, error) {
+	switch cfg.Storage.Backend {
+	case objectStorage.BackendFS:
+		return objectStorage.New(logger, cfg.Storage.Dir), nil
+	case objectStorage.BackendS3:
+		s3 := cfg.Storage.S3
+		return objectStorage.NewS3(ctx, logger, objectStorage.S3Config{
+			Endpoint:  s3.Endpoint,
+			Region:    s3.Region,
+			AccessKey: s3.AccessKey,
+			SecretKey: s3.SecretKey,
+			UseSSL:    s3.UseSSL,
+			Bucket:    s3.Bucket,
+			Prefix:    s3.Prefix,
+			PartSize:  s3.PartSize,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
 }
@@ -1,15 +1,17 @@
 package config
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Yury132/Golang-Task-2/internal/imaging"
+	"github.com/Yury132/Golang-Task-2/internal/models"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/kelseyhightower/envconfig"
-	"github.com/nats-io/nats.go/jetstream"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/pkgerrors"
 )
@@ -23,6 +25,10 @@ type Config struct {
 		Host        string `envconfig:"SERVER_HOST" default:":9000"`
 		MetricsBind string `envconfig:"BIND_METRICS" default:":9090"`
 		HealthHost  string `envconfig:"BIND_HEALTH" default:":9091"`
+		// Сколько ждать завершения запросов и задач при остановке
+		ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+		// Максимальный размер тела запроса на загрузку, в байтах
+		MaxUploadSize int64 `envconfig:"MAX_UPLOAD_SIZE" default:"33554432"`
 	}
 
 	Service struct {
@@ -42,6 +48,239 @@ type Config struct {
 	NATS struct {
 		URL string `envconfig:"NATS_URL" default:"nats://localhost:4222"`
 	}
+
+	Thumbnail struct {
+		// Пресеты в формате "имя=размер[:формат[:качество]],..."
+		Presets ThumbnailPresets `envconfig:"THUMBNAIL_PRESETS" default:"small=100,medium=400,large=1200"`
+		// Формат и качество для пресетов, где они не указаны
+		Format  string `envconfig:"THUMBNAIL_FORMAT" default:"png"`
+		Quality int    `envconfig:"THUMBNAIL_QUALITY" default:"80"`
+	}
+
+	Worker struct {
+		// Число воркеров, создающих миниатюры
+		Count int `envconfig:"WORKER_COUNT" default:"5"`
+		// Сколько сообщений запрашивать из Nats за раз
+		BatchSize int `envconfig:"WORKER_BATCH_SIZE" default:"10"`
+		// Сколько задач может быть получено, но еще не обработано
+		MaxInFlight int `envconfig:"WORKER_MAX_IN_FLIGHT" default:"20"`
+		// Максимальное число доставок одного сообщения
+		MaxDeliver int `envconfig:"WORKER_MAX_DELIVER" default:"5"`
+		// Задержки перед повторными доставками
+		BackOff []time.Duration `envconfig:"WORKER_BACKOFF" default:"1s,5s,30s,2m"`
+		// Сколько ждать подтверждения, прежде чем доставить сообщение снова
+		AckWait time.Duration `envconfig:"WORKER_ACK_WAIT" default:"1m"`
+	}
+
+	Outbox struct {
+		// Как часто проверять неотправленные сообщения
+		PollInterval time.Duration `envconfig:"OUTBOX_POLL_INTERVAL" default:"1s"`
+		// Сколько сообщений отправлять за раз
+		BatchSize int `envconfig:"OUTBOX_BATCH_SIZE" default:"100"`
+	}
+
+	Storage struct {
+		// fs - локальная папка, s3 - S3-совместимое хранилище
+		Backend string `envconfig:"STORAGE_BACKEND" default:"fs"`
+		// Папка для fs
+		Dir string `envconfig:"STORAGE_DIR" default:"uploads"`
+
+		S3 struct {
+			Endpoint  string `envconfig:"S3_ENDPOINT" default:"localhost:9000"`
+			Region    string `envconfig:"S3_REGION" default:"us-east-1"`
+			AccessKey string `envconfig:"S3_ACCESS_KEY" default:"minioadmin"`
+			SecretKey string `envconfig:"S3_SECRET_KEY" default:"minioadmin"`
+			UseSSL    bool   `envconfig:"S3_USE_SSL" default:"false"`
+			Bucket    string `envconfig:"S3_BUCKET" default:"uploads"`
+			Prefix    string `envconfig:"S3_PREFIX" default:""`
+			// Размер части при multipart загрузке, не меньше 5 МиБ
+			PartSize uint64 `envconfig:"S3_PART_SIZE" default:"16777216"`
+		}
+	}
+
+	Purge struct {
+		// Сколько удаленная загрузка хранится и может быть восстановлена
+		Window time.Duration `envconfig:"PURGE_WINDOW" default:"168h"`
+		// Как часто искать загрузки для окончательного удаления
+		Interval time.Duration `envconfig:"PURGE_INTERVAL" default:"1m"`
+		// Сколько загрузок удалять за раз
+		BatchSize int `envconfig:"PURGE_BATCH_SIZE" default:"100"`
+	}
+
+	Similarity struct {
+		// Максимальное расстояние Хэмминга между хэшами похожих изображений, от 0 до 64
+		MaxDistance int `envconfig:"SIMILAR_MAX_DISTANCE" default:"10"`
+	}
+
+	Webhook struct {
+		// Как часто проверять доставки, время которых подошло
+		PollInterval time.Duration `envconfig:"WEBHOOK_POLL_INTERVAL" default:"5s"`
+		// Сколько доставок отправлять за раз
+		BatchSize int `envconfig:"WEBHOOK_BATCH_SIZE" default:"50"`
+		// Сколько ждать ответа получателя
+		Timeout time.Duration `envconfig:"WEBHOOK_TIMEOUT" default:"10s"`
+		// Сколько попыток делать, прежде чем пометить доставку неудачной
+		MaxAttempts int `envconfig:"WEBHOOK_MAX_ATTEMPTS" default:"8"`
+		// Задержка перед второй попыткой, дальше удваивается, но не больше WEBHOOK_MAX_BACKOFF
+		BaseBackoff time.Duration `envconfig:"WEBHOOK_BASE_BACKOFF" default:"10s"`
+		MaxBackoff  time.Duration `envconfig:"WEBHOOK_MAX_BACKOFF" default:"1h"`
+		// Разрешить вебхуки на loopback и адреса внутренних сетей, только для локальной разработки
+		AllowPrivate bool `envconfig:"WEBHOOK_ALLOW_PRIVATE" default:"false"`
+	}
+
+	Auth struct {
+		// Ключ администратора (mk_...), не хранится в БД; нужен, чтобы выпустить первые ключи
+		AdminKey string `envconfig:"AUTH_ADMIN_KEY" default:""`
+		// Арендатор и владелец, от имени которых работает ключ администратора
+		AdminTenant string `envconfig:"AUTH_ADMIN_TENANT" default:"default"`
+		AdminOwner  string `envconfig:"AUTH_ADMIN_OWNER" default:"admin"`
+	}
+
+	JWT struct {
+		// JWKS провайдера: путь к файлу или адрес http(s)://, пустой - JWT не принимаются
+		JWKS string `envconfig:"JWT_JWKS" default:""`
+		// Ожидаемые iss и aud, пустые - не проверяются
+		Issuer   string `envconfig:"JWT_ISSUER" default:""`
+		Audience string `envconfig:"JWT_AUDIENCE" default:""`
+		// Claim с владельцем загрузок
+		OwnerClaim string `envconfig:"JWT_OWNER_CLAIM" default:"sub"`
+		// Claim с правами: строка через пробел или массив
+		ScopeClaim string `envconfig:"JWT_SCOPE_CLAIM" default:"scope"`
+		// Claim с арендатором, без него токен относится к арендатору default
+		TenantClaim string `envconfig:"JWT_TENANT_CLAIM" default:"tenant"`
+		// Допустимое расхождение часов при проверке exp и nbf
+		Leeway time.Duration `envconfig:"JWT_LEEWAY" default:"30s"`
+		// Как часто перечитывать JWKS
+		Refresh time.Duration `envconfig:"JWT_JWKS_REFRESH" default:"1h"`
+	}
+
+	Tenant struct {
+		// Лимиты арендатора по умолчанию: байты оригиналов и миниатюр и число загрузок, 0 - без ограничений
+		MaxBytes  int64 `envconfig:"TENANT_MAX_BYTES" default:"0"`
+		MaxImages int   `envconfig:"TENANT_MAX_IMAGES" default:"0"`
+		// Лимиты отдельных арендаторов в формате "арендатор=байты:загрузки,..."
+		Quotas TenantQuotas `envconfig:"TENANT_QUOTAS" default:""`
+	}
+
+	RateLimit struct {
+		// Загрузок в секунду от одного владельца ключа или токена, 0 - без ограничения
+		UploadRate float64 `envconfig:"RATE_LIMIT_UPLOAD_RPS" default:"5"`
+		// Сколько загрузок можно сделать подряд, прежде чем сработает ограничение
+		UploadBurst int `envconfig:"RATE_LIMIT_UPLOAD_BURST" default:"20"`
+		// Сколько загрузок читается и разбирается одновременно, 0 - без ограничения
+		MaxConcurrentUploads int `envconfig:"MAX_CONCURRENT_UPLOADS" default:"16"`
+		// Сколько загрузка может передавать тело, заняв место, 0 - без ограничения
+		UploadReadTimeout time.Duration `envconfig:"UPLOAD_READ_TIMEOUT" default:"2m"`
+	}
+
+	Imaging struct {
+		// native - чистый Go, vips - libvips (сборка с -tags vips)
+		Backend string `envconfig:"IMAGE_BACKEND" default:"native"`
+	}
+}
+
+// Набор пресетов миниатюр
+type ThumbnailPresets []models.ThumbnailPreset
+
+// Разбираем пресеты из переменной окружения
+func (p *ThumbnailPresets) Decode(value string) error {
+	presets := make(ThumbnailPresets, 0)
+	seen := make(map[string]struct{})
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, spec, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("invalid thumbnail preset %q", item)
+		}
+		if _, ok = seen[name]; ok {
+			return fmt.Errorf("duplicate thumbnail preset %q", name)
+		}
+		seen[name] = struct{}{}
+
+		// размер[:формат[:качество]]
+		parts := strings.Split(spec, ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid thumbnail preset %q", item)
+		}
+		preset := models.ThumbnailPreset{Name: name}
+
+		size, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid thumbnail preset size %q", item)
+		}
+		preset.Size = size
+
+		if len(parts) > 1 {
+			if preset.Format, err = imaging.ParseFormat(parts[1]); err != nil {
+				return fmt.Errorf("invalid thumbnail preset format %q", item)
+			}
+		}
+		if len(parts) > 2 {
+			quality, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+			if err != nil || quality < 1 || quality > 100 {
+				return fmt.Errorf("invalid thumbnail preset quality %q", item)
+			}
+			preset.Quality = quality
+		}
+
+		presets = append(presets, preset)
+	}
+
+	if len(presets) == 0 {
+		return fmt.Errorf("no thumbnail presets configured")
+	}
+
+	*p = presets
+	return nil
+}
+
+// Лимиты отдельных арендаторов
+type TenantQuotas map[string]models.Quota
+
+// Разбираем лимиты из переменной окружения
+func (q *TenantQuotas) Decode(value string) error {
+	quotas := make(TenantQuotas)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		tenant, spec, ok := strings.Cut(item, "=")
+		tenant = strings.TrimSpace(tenant)
+		if !ok || models.ValidateTenant(tenant) != nil {
+			return fmt.Errorf("invalid tenant quota %q", item)
+		}
+		if _, ok = quotas[tenant]; ok {
+			return fmt.Errorf("duplicate tenant quota %q", tenant)
+		}
+
+		// байты:загрузки
+		maxBytes, maxImages, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("invalid tenant quota %q", item)
+		}
+		var quota models.Quota
+		var err error
+		if quota.MaxBytes, err = strconv.ParseInt(strings.TrimSpace(maxBytes), 10, 64); err != nil || quota.MaxBytes < 0 {
+			return fmt.Errorf("invalid tenant quota bytes %q", item)
+		}
+		if quota.MaxImages, err = strconv.Atoi(strings.TrimSpace(maxImages)); err != nil || quota.MaxImages < 0 {
+			return fmt.Errorf("invalid tenant quota images %q", item)
+		}
+
+		quotas[tenant] = quota
+	}
+
+	*q = quotas
+	return nil
 }
 
 func Parse() (*Config, error) {
@@ -53,9 +292,98 @@ func Parse() (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.Worker.Count < 1 || cfg.Worker.BatchSize < 1 || cfg.Worker.MaxInFlight < 1 {
+		return nil, fmt.Errorf("WORKER_COUNT, WORKER_BATCH_SIZE and WORKER_MAX_IN_FLIGHT must be positive")
+	}
+
+	if cfg.Server.MaxUploadSize < 1 {
+		return nil, fmt.Errorf("MAX_UPLOAD_SIZE must be positive")
+	}
+
+	if cfg.Purge.Window < 0 || cfg.Purge.Interval <= 0 || cfg.Purge.BatchSize < 1 {
+		return nil, fmt.Errorf("PURGE_WINDOW must not be negative, PURGE_INTERVAL and PURGE_BATCH_SIZE must be positive")
+	}
+
+	if cfg.Similarity.MaxDistance < 0 || cfg.Similarity.MaxDistance > 64 {
+		return nil, fmt.Errorf("SIMILAR_MAX_DISTANCE must be between 0 and 64")
+	}
+
+	if cfg.Webhook.PollInterval <= 0 || cfg.Webhook.BatchSize < 1 || cfg.Webhook.Timeout <= 0 || cfg.Webhook.MaxAttempts < 1 {
+		return nil, fmt.Errorf("WEBHOOK_POLL_INTERVAL, WEBHOOK_BATCH_SIZE, WEBHOOK_TIMEOUT and WEBHOOK_MAX_ATTEMPTS must be positive")
+	}
+	if cfg.Webhook.BaseBackoff <= 0 || cfg.Webhook.MaxBackoff < cfg.Webhook.BaseBackoff {
+		return nil, fmt.Errorf("WEBHOOK_BASE_BACKOFF must be positive and not greater than WEBHOOK_MAX_BACKOFF")
+	}
+
+	if cfg.Auth.AdminKey != "" && (!strings.HasPrefix(cfg.Auth.AdminKey, "mk_") || len(cfg.Auth.AdminKey) < 35) {
+		return nil, fmt.Errorf("AUTH_ADMIN_KEY must start with mk_ and contain at least 32 characters after it")
+	}
+	if cfg.Auth.AdminOwner == "" {
+		return nil, fmt.Errorf("AUTH_ADMIN_OWNER must not be empty")
+	}
+
+	if models.ValidateTenant(cfg.Auth.AdminTenant) != nil {
+		return nil, fmt.Errorf("AUTH_ADMIN_TENANT must be a valid tenant name")
+	}
+
+	if cfg.JWT.OwnerClaim == "" || cfg.JWT.ScopeClaim == "" || cfg.JWT.TenantClaim == "" {
+		return nil, fmt.Errorf("JWT_OWNER_CLAIM, JWT_SCOPE_CLAIM and JWT_TENANT_CLAIM must not be empty")
+	}
+	if cfg.JWT.Leeway < 0 || cfg.JWT.Refresh <= 0 {
+		return nil, fmt.Errorf("JWT_LEEWAY must not be negative and JWT_JWKS_REFRESH must be positive")
+	}
+
+	if cfg.Tenant.MaxBytes < 0 || cfg.Tenant.MaxImages < 0 {
+		return nil, fmt.Errorf("TENANT_MAX_BYTES and TENANT_MAX_IMAGES must not be negative")
+	}
+
+	if cfg.RateLimit.UploadRate < 0 || (cfg.RateLimit.UploadRate > 0 && cfg.RateLimit.UploadBurst < 1) {
+		return nil, fmt.Errorf("RATE_LIMIT_UPLOAD_RPS must not be negative and RATE_LIMIT_UPLOAD_BURST must be positive")
+	}
+	if cfg.RateLimit.MaxConcurrentUploads < 0 || cfg.RateLimit.UploadReadTimeout < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_UPLOADS and UPLOAD_READ_TIMEOUT must not be negative")
+	}
+
+	// JetStream требует, чтобы доставок было больше, чем задержек
+	if cfg.Worker.MaxDeliver <= len(cfg.Worker.BackOff) {
+		return nil, fmt.Errorf("WORKER_MAX_DELIVER must be greater than the number of WORKER_BACKOFF values")
+	}
+
 	return cfg, nil
 }
 
+// Пресеты миниатюр с подставленными форматом и качеством по умолчанию
+func (cfg Config) ThumbnailPresets() ([]models.ThumbnailPreset, error) {
+	format, err := imaging.ParseFormat(cfg.Thumbnail.Format)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Thumbnail.Quality < 1 || cfg.Thumbnail.Quality > 100 {
+		return nil, fmt.Errorf("invalid thumbnail quality %d", cfg.Thumbnail.Quality)
+	}
+
+	presets := make([]models.ThumbnailPreset, 0, len(cfg.Thumbnail.Presets))
+	for _, preset := range cfg.Thumbnail.Presets {
+		if preset.Format == "" {
+			preset.Format = format
+		}
+		if preset.Quality == 0 {
+			preset.Quality = cfg.Thumbnail.Quality
+		}
+		presets = append(presets, preset)
+	}
+
+	return presets, nil
+}
+
+// Лимиты арендаторов
+func (cfg Config) QuotaPolicy() models.QuotaPolicy {
+	return models.QuotaPolicy{
+		Default: models.Quota{MaxBytes: cfg.Tenant.MaxBytes, MaxImages: cfg.Tenant.MaxImages},
+		Tenants: cfg.Tenant.Quotas,
+	}
+}
+
 // Логгер
 func (cfg Config) Logger() (logger zerolog.Logger) {
 	level := zerolog.InfoLevel
@@ -100,21 +428,3 @@ func (cfg Config) PgPoolConfig() (*pgxpool.Config, error) {
 
 	return poolCfg, nil
 }
-
-// Стрим для nats
-func (cfg Config) NewStream(ctx context.Context, js jetstream.JetStream) (jetstream.Stream, error) {
-	streamCfg := jetstream.StreamConfig{
-		Name: "EVENTS",
-		// Очередь
-		Retention: jetstream.WorkQueuePolicy,
-		// Топики
-		Subjects: []string{"media.>"},
-	}
-
-	stream, err := js.CreateStream(ctx, streamCfg)
-	if err != nil {
-		return nil, err
-	}
-
-	return stream, nil
-}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+)
+
+func TestTenantQuotasDecode(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    TenantQuotas
+		wantErr bool
+	}{
+		{value: "", want: TenantQuotas{}},
+		{value: " , ", want: TenantQuotas{}},
+		{value: "acme=1000:10", want: TenantQuotas{"acme": {MaxBytes: 1000, MaxImages: 10}}},
+		{
+			value: " acme = 1000 : 10 , free=0:0,big-co=1073741824:0 ",
+			want: TenantQuotas{
+				"acme":   {MaxBytes: 1000, MaxImages: 10},
+				"free":   {},
+				"big-co": {MaxBytes: 1 << 30},
+			},
+		},
+		{value: "acme", wantErr: true},
+		{value: "acme=1000", wantErr: true},
+		{value: "=1000:10", wantErr: true},
+		{value: "Acme=1000:10", wantErr: true},
+		{value: "dlq=1000:10", wantErr: true},
+		{value: "events=1000:10", wantErr: true},
+		{value: "acme=1000:10,acme=2000:20", wantErr: true},
+		{value: "acme=-1:10", wantErr: true},
+		{value: "acme=1000:-1", wantErr: true},
+		{value: "acme=1kb:10", wantErr: true},
+		{value: "acme=1000:ten", wantErr: true},
+		{value: "acme=:10", wantErr: true},
+	}
+	for _, tt := range tests {
+		var got TenantQuotas
+		err := got.Decode(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Decode(%q) = %v, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Decode(%q): %v", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaPolicy(t *testing.T) {
+	var cfg Config
+	cfg.Tenant.MaxBytes = 100
+	cfg.Tenant.MaxImages = 10
+	if err := cfg.Tenant.Quotas.Decode("acme=1000:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := cfg.QuotaPolicy()
+	if got := policy.For("acme"); got != (models.Quota{MaxBytes: 1000}) {
+		t.Errorf("For(acme) = %+v", got)
+	}
+	if got := policy.For("other"); got != (models.Quota{MaxBytes: 100, MaxImages: 10}) {
+		t.Errorf("For(other) = %+v", got)
+	}
+}
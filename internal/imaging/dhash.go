@@ -0,0 +1,45 @@
+package imaging
+
+import (
+	"image"
+
+	"github.com/nfnt/resize"
+)
+
+// Размер уменьшенной копии для dHash: 9x8 дает 8 сравнений в строке, 64 бита
+const (
+	dHashWidth  = 9
+	dHashHeight = 8
+)
+
+// Разностный хэш (dHash): уменьшаем до 9x8 в оттенках серого
+// и для каждой пары соседних пикселей в строке ставим бит, если левый ярче правого.
+// Пережатые и уменьшенные копии дают хэши с малым расстоянием Хэмминга
+func dHash(img image.Image) uint64 {
+	small := img
+	if b := img.Bounds(); b.Dx() != dHashWidth || b.Dy() != dHashHeight {
+		small = resize.Resize(dHashWidth, dHashHeight, img, resize.Bilinear)
+	}
+	bounds := small.Bounds()
+
+	var hash uint64
+	for y := 0; y < dHashHeight; y++ {
+		left := luminance(small, bounds.Min.X, bounds.Min.Y+y)
+		for x := 1; x < dHashWidth; x++ {
+			right := luminance(small, bounds.Min.X+x, bounds.Min.Y+y)
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+			left = right
+		}
+	}
+
+	return hash
+}
+
+// Яркость пикселя по формуле ITU-R BT.601
+func luminance(img image.Image, x, y int) uint32 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (299*r + 587*g + 114*b) / 1000
+}
@@ -0,0 +1,123 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+)
+
+type nativeImage struct {
+	img    image.Image
+	format string
+}
+
+func (i *nativeImage) Width() int {
+	return i.img.Bounds().Dx()
+}
+
+func (i *nativeImage) Height() int {
+	return i.img.Bounds().Dy()
+}
+
+// Память освобождает сборщик мусора
+func (i *nativeImage) Close() {}
+
+// Реализация на чистом Go
+type nativeProcessor struct{}
+
+// Декодирование изображения
+func (p *nativeProcessor) Decode(r io.Reader) (Image, error) {
+	recorder := &readRecorder{r: r}
+	img, format, err := image.Decode(recorder)
+	if err != nil {
+		return nil, recorder.decodeError(err)
+	}
+
+	return &nativeImage{img: img, format: format}, nil
+}
+
+// Уменьшение по наибольшей стороне
+func (p *nativeProcessor) Resize(img Image, size int) (Image, error) {
+	src, err := p.unwrap(img)
+	if err != nil {
+		return nil, err
+	}
+
+	resized := resize.Thumbnail(uint(size), uint(size), src.img, resize.Lanczos3)
+
+	return &nativeImage{img: resized, format: src.format}, nil
+}
+
+// Кодирование в заданный формат
+// WebP и AVIF на чистом Go не кодируются
+func (p *nativeProcessor) Encode(img Image, format string, quality int) ([]byte, error) {
+	src, err := p.unwrap(img)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	switch format {
+	case FormatPNG:
+		err = png.Encode(buf, src.img)
+	case FormatJPEG:
+		var opts *jpeg.Options
+		if quality > 0 {
+			opts = &jpeg.Options{Quality: quality}
+		}
+		err = jpeg.Encode(buf, src.img, opts)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode %s", format)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Поддерживается ли кодирование в формат
+func (p *nativeProcessor) Supports(format string) bool {
+	return format == FormatPNG || format == FormatJPEG
+}
+
+// Метаданные изображения
+func (p *nativeProcessor) Metadata(img Image) Metadata {
+	meta := Metadata{Width: img.Width(), Height: img.Height()}
+	if src, ok := img.(*nativeImage); ok {
+		meta.Format = src.format
+	}
+
+	return meta
+}
+
+// Перцептивный хэш (dHash) для поиска похожих изображений
+func (p *nativeProcessor) DHash(img Image) (uint64, error) {
+	src, err := p.unwrap(img)
+	if err != nil {
+		return 0, err
+	}
+
+	return dHash(src.img), nil
+}
+
+func (p *nativeProcessor) Shutdown() {}
+
+func (p *nativeProcessor) unwrap(img Image) (*nativeImage, error) {
+	src, ok := img.(*nativeImage)
+	if !ok {
+		return nil, fmt.Errorf("image %T was not decoded by native backend", img)
+	}
+
+	return src, nil
+}
+
+func newNative() ImageProcessor {
+	return &nativeProcessor{}
+}
@@ -0,0 +1,62 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// Читатель, который отдает часть данных и падает
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestNativeDecodeErrors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	p := newNative()
+
+	tests := []struct {
+		name      string
+		r         io.Reader
+		permanent bool
+	}{
+		{"unknown format", bytes.NewReader([]byte("not an image")), true},
+		{"truncated", bytes.NewReader(valid[:len(valid)/2]), true},
+		{"read error", &failingReader{data: valid[:len(valid)/2]}, false},
+	}
+	for _, tt := range tests {
+		_, err := p.Decode(tt.r)
+		if err == nil {
+			t.Errorf("%s: Decode succeeded", tt.name)
+			continue
+		}
+		if errors.Is(err, ErrDecode) != tt.permanent {
+			t.Errorf("%s: Decode error = %v, ErrDecode = %v", tt.name, err, !tt.permanent)
+		}
+	}
+
+	img, err := p.Decode(bytes.NewReader(valid))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if img.Width() != 16 {
+		t.Fatalf("width = %d, want 16", img.Width())
+	}
+}
@@ -0,0 +1,122 @@
+package imaging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Изображение повреждено или в неподдерживаемом формате, повторное декодирование не поможет
+var ErrDecode = errors.New("invalid image")
+
+// Доступные реализации обработки изображений
+const (
+	// Чистый Go (image + nfnt/resize), работает без libvips
+	BackendNative = "native"
+	// libvips через govips, собирается с тегом vips
+	BackendVips = "vips"
+)
+
+// Форматы изображений
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatWebP = "webp"
+	FormatAVIF = "avif"
+)
+
+// Расширения файлов для форматов
+var extensions = map[string]string{
+	FormatPNG:  ".png",
+	FormatJPEG: ".jpg",
+	FormatWebP: ".webp",
+	FormatAVIF: ".avif",
+}
+
+// Приводим название формата к каноническому виду
+func ParseFormat(value string) (string, error) {
+	format := strings.ToLower(strings.TrimSpace(value))
+	if format == "jpg" {
+		format = FormatJPEG
+	}
+	if _, ok := extensions[format]; !ok {
+		return "", fmt.Errorf("unknown image format %q", value)
+	}
+
+	return format, nil
+}
+
+// Расширение файла для формата
+func Extension(format string) string {
+	return extensions[format]
+}
+
+// Декодированное изображение, конкретный тип зависит от реализации
+type Image interface {
+	// Ширина
+	Width() int
+	// Высота
+	Height() int
+	// Освобождение ресурсов
+	Close()
+}
+
+// Метаданные изображения
+type Metadata struct {
+	Format string
+	Width  int
+	Height int
+}
+
+type ImageProcessor interface {
+	// Декодирование изображения
+	Decode(r io.Reader) (Image, error)
+	// Уменьшение по наибольшей стороне до size пикселей, исходное изображение не меняется
+	Resize(img Image, size int) (Image, error)
+	// Кодирование в заданный формат, quality 0 - качество по умолчанию
+	Encode(img Image, format string, quality int) ([]byte, error)
+	// Поддерживается ли кодирование в формат
+	Supports(format string) bool
+	// Метаданные изображения
+	Metadata(img Image) Metadata
+	// Перцептивный хэш (dHash) для поиска похожих изображений
+	DHash(img Image) (uint64, error)
+	// Освобождение ресурсов библиотеки
+	Shutdown()
+}
+
+// Запоминает ошибку чтения, чтобы отличить сбой ввода-вывода от битого изображения
+type readRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// Ошибка декодирования: сбой чтения возвращаем как есть, остальное считаем битым изображением
+func (r *readRecorder) decodeError(err error) error {
+	if r.err != nil {
+		return errors.Wrap(r.err, "failed to read image")
+	}
+	return errors.Wrapf(ErrDecode, "failed to decode image: %v", err)
+}
+
+// Создаем обработчик изображений по имени реализации
+func New(backend string) (ImageProcessor, error) {
+	switch backend {
+	case BackendNative, "":
+		return newNative(), nil
+	case BackendVips:
+		return newVips()
+	default:
+		return nil, fmt.Errorf("unknown image backend %q", backend)
+	}
+}
@@ -0,0 +1,166 @@
+//go:build vips
+
+package imaging
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/pkg/errors"
+)
+
+// libvips инициализируется один раз на процесс
+var vipsStartup sync.Once
+
+type vipsImage struct {
+	ref *vips.ImageRef
+}
+
+func (i *vipsImage) Width() int {
+	return i.ref.Width()
+}
+
+func (i *vipsImage) Height() int {
+	return i.ref.Height()
+}
+
+func (i *vipsImage) Close() {
+	i.ref.Close()
+}
+
+// Реализация через libvips
+type vipsProcessor struct{}
+
+// Декодирование изображения
+func (p *vipsProcessor) Decode(r io.Reader) (Image, error) {
+	recorder := &readRecorder{r: r}
+	ref, err := vips.NewImageFromReader(recorder)
+	if err != nil {
+		return nil, recorder.decodeError(err)
+	}
+
+	return &vipsImage{ref: ref}, nil
+}
+
+// Уменьшение по наибольшей стороне
+func (p *vipsProcessor) Resize(img Image, size int) (Image, error) {
+	src, err := p.unwrap(img)
+	if err != nil {
+		return nil, err
+	}
+
+	// Thumbnail меняет изображение на месте, поэтому работаем с копией
+	ref, err := src.ref.Copy()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to copy image")
+	}
+	if err = ref.Thumbnail(size, size, vips.InterestingNone); err != nil {
+		ref.Close()
+		return nil, errors.Wrap(err, "failed to resize image")
+	}
+
+	return &vipsImage{ref: ref}, nil
+}
+
+// Кодирование в заданный формат
+func (p *vipsProcessor) Encode(img Image, format string, quality int) ([]byte, error) {
+	src, err := p.unwrap(img)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	switch format {
+	case FormatPNG:
+		// PNG сжимается без потерь, качество не учитывается
+		data, _, err = src.ref.ExportPng(vips.NewPngExportParams())
+	case FormatJPEG:
+		params := vips.NewJpegExportParams()
+		if quality > 0 {
+			params.Quality = quality
+		}
+		data, _, err = src.ref.ExportJpeg(params)
+	case FormatWebP:
+		params := vips.NewWebpExportParams()
+		if quality > 0 {
+			params.Quality = quality
+		}
+		data, _, err = src.ref.ExportWebp(params)
+	case FormatAVIF:
+		params := vips.NewAvifExportParams()
+		if quality > 0 {
+			params.Quality = quality
+		}
+		data, _, err = src.ref.ExportAvif(params)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode %s", format)
+	}
+
+	return data, nil
+}
+
+// Поддерживается ли кодирование в формат
+func (p *vipsProcessor) Supports(format string) bool {
+	return Extension(format) != ""
+}
+
+// Метаданные изображения
+func (p *vipsProcessor) Metadata(img Image) Metadata {
+	meta := Metadata{Width: img.Width(), Height: img.Height()}
+	if src, ok := img.(*vipsImage); ok {
+		meta.Format = vips.ImageTypes[src.ref.Format()]
+	}
+
+	return meta
+}
+
+// Перцептивный хэш (dHash) для поиска похожих изображений
+// Уменьшаем средствами libvips, чтобы не переводить в image.Image весь оригинал
+func (p *vipsProcessor) DHash(img Image) (uint64, error) {
+	src, err := p.unwrap(img)
+	if err != nil {
+		return 0, err
+	}
+
+	ref, err := src.ref.Copy()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to copy image")
+	}
+	defer ref.Close()
+
+	if err = ref.ThumbnailWithSize(dHashWidth, dHashHeight, vips.InterestingNone, vips.SizeForce); err != nil {
+		return 0, errors.Wrap(err, "failed to resize image")
+	}
+	small, err := ref.ToImage(nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to convert image")
+	}
+
+	return dHash(small), nil
+}
+
+func (p *vipsProcessor) Shutdown() {
+	vips.Shutdown()
+}
+
+func (p *vipsProcessor) unwrap(img Image) (*vipsImage, error) {
+	src, ok := img.(*vipsImage)
+	if !ok {
+		return nil, fmt.Errorf("image %T was not decoded by vips backend", img)
+	}
+
+	return src, nil
+}
+
+func newVips() (ImageProcessor, error) {
+	vipsStartup.Do(func() {
+		vips.Startup(nil)
+	})
+
+	return &vipsProcessor{}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !vips
+
+package imaging
+
+import "errors"
+
+// Без тега vips libvips не подключается, доступна только реализация на Go
+func newVips() (ImageProcessor, error) {
+	return nil, errors.New("vips backend is not compiled in, rebuild with -tags vips")
+}
@@ -0,0 +1,66 @@
+package lifecycle
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Шаг остановки приложения
+type hook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Управление остановкой приложения
+// Шаги выполняются в порядке добавления, все укладываются в общий срок
+type Manager struct {
+	log     zerolog.Logger
+	timeout time.Duration
+	hooks   []hook
+}
+
+// Добавляем шаг остановки
+func (m *Manager) Add(name string, stop func(ctx context.Context) error) {
+	m.hooks = append(m.hooks, hook{name: name, stop: stop})
+}
+
+// Ждем SIGINT или SIGTERM, затем останавливаем приложение
+func (m *Manager) Wait() {
+	// Фиксируем нажатие Ctrl+C или сигнал от оркестратора
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(shutdown)
+
+	sig := <-shutdown
+	m.log.Info().Str("signal", sig.String()).Msg("Shutting down...")
+
+	m.Shutdown()
+}
+
+// Выполняем все шаги остановки
+// Ошибка одного шага не отменяет следующие: соединения нужно закрыть в любом случае
+func (m *Manager) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	for _, h := range m.hooks {
+		start := time.Now()
+		if err := h.stop(ctx); err != nil {
+			m.log.Error().Err(err).Str("step", h.name).Msg("shutdown step failed")
+			continue
+		}
+		m.log.Info().Str("step", h.name).Dur("took", time.Since(start)).Msg("Stopped")
+	}
+}
+
+func New(log zerolog.Logger, timeout time.Duration) *Manager {
+	return &Manager{
+		log:     log,
+		timeout: timeout,
+	}
+}
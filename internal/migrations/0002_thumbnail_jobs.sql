@@ -0,0 +1,31 @@
+-- +goose Up
+alter table public.mini_info
+    add column if not exists upload_id int references public.uploads_info (id) on delete cascade;
+
+-- Раньше миниатюры связывались с оригиналом по совпадению id
+update public.mini_info mi
+set upload_id = mi.id
+where mi.upload_id is null
+  and exists(select 1 from public.uploads_info ui where ui.id = mi.id);
+
+create index if not exists mini_info_upload_id_idx on public.mini_info (upload_id);
+
+create table if not exists public.thumbnail_jobs
+(
+    id         serial primary key,
+    upload_id  int          not null references public.uploads_info (id) on delete cascade,
+    status     varchar(32)  not null default 'pending',
+    error      text,
+    created_at timestamp    not null default now(),
+    updated_at timestamp    not null default now()
+);
+
+create index if not exists thumbnail_jobs_upload_id_idx on public.thumbnail_jobs (upload_id);
+
+-- +goose Down
+drop table public.thumbnail_jobs;
+
+drop index if exists public.mini_info_upload_id_idx;
+
+alter table public.mini_info
+    drop column upload_id;
@@ -0,0 +1,18 @@
+-- +goose Up
+alter table public.mini_info
+    add column if not exists preset varchar(64) not null default 'default';
+
+alter table public.thumbnail_jobs
+    add column if not exists preset varchar(64) not null default 'default';
+
+-- Для одного оригинала - одна миниатюра на каждый пресет
+create unique index if not exists mini_info_upload_id_preset_idx on public.mini_info (upload_id, preset);
+
+-- +goose Down
+drop index if exists public.mini_info_upload_id_preset_idx;
+
+alter table public.thumbnail_jobs
+    drop column preset;
+
+alter table public.mini_info
+    drop column preset;
@@ -0,0 +1,20 @@
+-- +goose Up
+create table if not exists public.dead_letters
+(
+    id         serial primary key,
+    stream_seq bigint       not null unique,
+    job_id     int          references public.thumbnail_jobs (id) on delete set null,
+    upload_id  int          references public.uploads_info (id) on delete cascade,
+    subject    varchar(255) not null,
+    payload    bytea        not null,
+    error      text         not null default '',
+    attempts   int          not null default 0,
+    status     varchar(32)  not null default 'dead',
+    created_at timestamp    not null default now(),
+    updated_at timestamp    not null default now()
+);
+
+create index if not exists dead_letters_status_idx on public.dead_letters (status, created_at);
+
+-- +goose Down
+drop table public.dead_letters;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Сообщения, записанные вместе с загрузкой и еще не отправленные в Nats
+create table if not exists public.outbox
+(
+    id         bigserial primary key,
+    subject    varchar(255) not null,
+    msg_id     varchar(255) not null unique,
+    payload    bytea        not null,
+    attempts   int          not null default 0,
+    last_error text,
+    created_at timestamp    not null default now()
+);
+
+-- +goose Down
+drop table public.outbox;
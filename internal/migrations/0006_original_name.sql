@@ -0,0 +1,12 @@
+-- +goose Up
+-- Имя файла от клиента хранится только как метаданные, name - ключ в хранилище
+alter table public.uploads_info
+    add column if not exists original_name varchar(500);
+
+update public.uploads_info
+set original_name = name
+where original_name is null;
+
+-- +goose Down
+alter table public.uploads_info
+    drop column original_name;
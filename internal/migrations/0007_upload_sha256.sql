@@ -0,0 +1,20 @@
+-- +goose Up
+-- Хэш содержимого оригинала для поиска повторных загрузок
+alter table public.uploads_info
+    add column if not exists sha256 varchar(64);
+
+-- Принудительно сохраненная копия ссылается на первую загрузку с тем же содержимым
+alter table public.uploads_info
+    add column if not exists duplicate_of int references public.uploads_info (id) on delete set null;
+
+-- Одинаковое содержимое может быть только у одной загрузки, кроме принудительных копий
+create unique index if not exists uploads_info_sha256_idx on public.uploads_info (sha256) where duplicate_of is null;
+
+-- +goose Down
+drop index if exists public.uploads_info_sha256_idx;
+
+alter table public.uploads_info
+    drop column duplicate_of;
+
+alter table public.uploads_info
+    drop column sha256;
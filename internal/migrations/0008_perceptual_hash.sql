@@ -0,0 +1,8 @@
+-- +goose Up
+-- Перцептивный хэш (dHash) оригинала, считается воркером при создании миниатюр
+alter table public.uploads_info
+    add column if not exists phash bigint;
+
+-- +goose Down
+alter table public.uploads_info
+    drop column phash;
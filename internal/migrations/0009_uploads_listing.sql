@@ -0,0 +1,27 @@
+-- +goose Up
+-- Индексы для постраничного списка загрузок: сортировка по ключу и id, фильтры
+create index if not exists uploads_info_upload_at_idx on public.uploads_info (upload_at, id);
+
+create index if not exists uploads_info_width_idx on public.uploads_info (coalesce(width, 0), id);
+
+create index if not exists uploads_info_height_idx on public.uploads_info (coalesce(height, 0), id);
+
+create index if not exists uploads_info_original_name_idx on public.uploads_info (coalesce(original_name, ''), id);
+
+-- Поиск по префиксу имени через LIKE 'prefix%'
+create index if not exists uploads_info_original_name_prefix_idx on public.uploads_info (coalesce(original_name, '') text_pattern_ops);
+
+create index if not exists uploads_info_type_idx on public.uploads_info (type);
+
+-- +goose Down
+drop index if exists public.uploads_info_type_idx;
+
+drop index if exists public.uploads_info_original_name_prefix_idx;
+
+drop index if exists public.uploads_info_original_name_idx;
+
+drop index if exists public.uploads_info_height_idx;
+
+drop index if exists public.uploads_info_width_idx;
+
+drop index if exists public.uploads_info_upload_at_idx;
@@ -0,0 +1,34 @@
+-- +goose Up
+-- Удаленная загрузка хранится до истечения окна очистки и может быть восстановлена
+alter table public.uploads_info
+    add column if not exists deleted_at timestamp;
+
+create index if not exists uploads_info_deleted_at_idx on public.uploads_info (deleted_at) where deleted_at is not null;
+
+-- Удаленные загрузки не мешают загрузить то же содержимое снова
+drop index if exists public.uploads_info_sha256_idx;
+
+create unique index if not exists uploads_info_sha256_idx on public.uploads_info (sha256) where duplicate_of is null and deleted_at is null;
+
+-- Сообщение задачи, чтобы после восстановления отправить отмененную задачу повторно
+alter table public.thumbnail_jobs
+    add column if not exists subject varchar(255);
+
+alter table public.thumbnail_jobs
+    add column if not exists payload bytea;
+
+-- +goose Down
+alter table public.thumbnail_jobs
+    drop column payload;
+
+alter table public.thumbnail_jobs
+    drop column subject;
+
+drop index if exists public.uploads_info_sha256_idx;
+
+create unique index if not exists uploads_info_sha256_idx on public.uploads_info (sha256) where duplicate_of is null;
+
+drop index if exists public.uploads_info_deleted_at_idx;
+
+alter table public.uploads_info
+    drop column deleted_at;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- Число попыток и время начала и завершения последней попытки
+alter table public.thumbnail_jobs
+    add column if not exists attempts int not null default 0;
+
+alter table public.thumbnail_jobs
+    add column if not exists started_at timestamp;
+
+alter table public.thumbnail_jobs
+    add column if not exists finished_at timestamp;
+
+-- +goose Down
+alter table public.thumbnail_jobs
+    drop column finished_at;
+
+alter table public.thumbnail_jobs
+    drop column started_at;
+
+alter table public.thumbnail_jobs
+    drop column attempts;
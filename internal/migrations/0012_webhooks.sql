@@ -0,0 +1,38 @@
+-- +goose Up
+create table if not exists public.webhooks
+(
+    id         serial primary key,
+    url        text         not null,
+    -- Ключ для подписи HMAC-SHA256
+    secret     varchar(255) not null,
+    -- Пустой список - все события
+    events     text[]       not null default '{}',
+    active     boolean      not null default true,
+    created_at timestamp    not null default now()
+);
+
+-- Журнал доставки: по записи на каждое событие для каждого подписанного вебхука
+create table if not exists public.webhook_deliveries
+(
+    id               bigserial primary key,
+    webhook_id       int          not null references public.webhooks (id) on delete cascade,
+    event            varchar(64)  not null,
+    payload          bytea        not null,
+    status           varchar(32)  not null default 'pending',
+    attempts         int          not null default 0,
+    last_status_code int,
+    last_error       text,
+    next_attempt_at  timestamp    not null default now(),
+    created_at       timestamp    not null default now(),
+    updated_at       timestamp    not null default now(),
+    delivered_at     timestamp
+);
+
+create index if not exists webhook_deliveries_due_idx on public.webhook_deliveries (next_attempt_at) where status = 'pending';
+
+create index if not exists webhook_deliveries_webhook_id_idx on public.webhook_deliveries (webhook_id, id);
+
+-- +goose Down
+drop table public.webhook_deliveries;
+
+drop table public.webhooks;
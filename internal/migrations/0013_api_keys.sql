@@ -0,0 +1,105 @@
+-- +goose Up
+-- API ключи хранятся только в виде SHA-256, сам ключ выдается один раз при создании
+create table if not exists public.api_keys
+(
+    id         serial primary key,
+    owner_id   varchar(255) not null,
+    name       varchar(255) not null default '',
+    -- Начало ключа, чтобы отличать ключи в списке
+    prefix     varchar(16)  not null,
+    key_hash   varchar(64)  not null unique,
+    -- Управление ключами и недоставленными задачами
+    admin      boolean      not null default false,
+    created_at timestamp    not null default now(),
+    revoked_at timestamp
+);
+
+create index if not exists api_keys_owner_id_idx on public.api_keys (owner_id);
+
+-- Загрузки, сделанные до появления ключей, принадлежат владельцу legacy
+alter table public.uploads_info
+    add column if not exists owner_id varchar(255);
+
+update public.uploads_info set owner_id = 'legacy' where owner_id is null;
+
+alter table public.uploads_info
+    alter column owner_id set not null;
+
+alter table public.webhooks
+    add column if not exists owner_id varchar(255);
+
+update public.webhooks set owner_id = 'legacy' where owner_id is null;
+
+alter table public.webhooks
+    alter column owner_id set not null;
+
+create index if not exists webhooks_owner_id_idx on public.webhooks (owner_id);
+
+-- Повтором считается то же содержимое у того же владельца
+drop index if exists public.uploads_info_sha256_idx;
+
+create unique index if not exists uploads_info_sha256_idx on public.uploads_info (owner_id, sha256) where duplicate_of is null and deleted_at is null;
+
+-- Список загрузок всегда фильтруется по владельцу, индексы из 0009 начинаются с него
+drop index if exists public.uploads_info_upload_at_idx;
+
+drop index if exists public.uploads_info_width_idx;
+
+drop index if exists public.uploads_info_height_idx;
+
+drop index if exists public.uploads_info_original_name_idx;
+
+drop index if exists public.uploads_info_original_name_prefix_idx;
+
+drop index if exists public.uploads_info_type_idx;
+
+create index if not exists uploads_info_upload_at_idx on public.uploads_info (owner_id, upload_at, id);
+
+create index if not exists uploads_info_width_idx on public.uploads_info (owner_id, coalesce(width, 0), id);
+
+create index if not exists uploads_info_height_idx on public.uploads_info (owner_id, coalesce(height, 0), id);
+
+create index if not exists uploads_info_original_name_idx on public.uploads_info (owner_id, coalesce(original_name, ''), id);
+
+create index if not exists uploads_info_original_name_prefix_idx on public.uploads_info (owner_id, coalesce(original_name, '') text_pattern_ops);
+
+create index if not exists uploads_info_type_idx on public.uploads_info (owner_id, type);
+
+-- +goose Down
+drop index if exists public.uploads_info_type_idx;
+
+drop index if exists public.uploads_info_original_name_prefix_idx;
+
+drop index if exists public.uploads_info_original_name_idx;
+
+drop index if exists public.uploads_info_height_idx;
+
+drop index if exists public.uploads_info_width_idx;
+
+drop index if exists public.uploads_info_upload_at_idx;
+
+create index if not exists uploads_info_upload_at_idx on public.uploads_info (upload_at, id);
+
+create index if not exists uploads_info_width_idx on public.uploads_info (coalesce(width, 0), id);
+
+create index if not exists uploads_info_height_idx on public.uploads_info (coalesce(height, 0), id);
+
+create index if not exists uploads_info_original_name_idx on public.uploads_info (coalesce(original_name, ''), id);
+
+create index if not exists uploads_info_original_name_prefix_idx on public.uploads_info (coalesce(original_name, '') text_pattern_ops);
+
+create index if not exists uploads_info_type_idx on public.uploads_info (type);
+
+drop index if exists public.uploads_info_sha256_idx;
+
+create unique index if not exists uploads_info_sha256_idx on public.uploads_info (sha256) where duplicate_of is null and deleted_at is null;
+
+drop index if exists public.webhooks_owner_id_idx;
+
+alter table public.webhooks
+    drop column owner_id;
+
+alter table public.uploads_info
+    drop column owner_id;
+
+drop table public.api_keys;
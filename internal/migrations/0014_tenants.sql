@@ -0,0 +1,154 @@
+-- +goose Up
+-- Арендатор у загрузок, миниатюр, ключей и вебхуков; существующие данные - арендатора default
+alter table public.uploads_info
+    add column if not exists tenant_id varchar(63) not null default 'default';
+
+alter table public.uploads_info
+    alter column tenant_id drop default;
+
+alter table public.mini_info
+    add column if not exists tenant_id varchar(63) not null default 'default';
+
+alter table public.mini_info
+    alter column tenant_id drop default;
+
+alter table public.api_keys
+    add column if not exists tenant_id varchar(63) not null default 'default';
+
+alter table public.api_keys
+    alter column tenant_id drop default;
+
+alter table public.webhooks
+    add column if not exists tenant_id varchar(63) not null default 'default';
+
+alter table public.webhooks
+    alter column tenant_id drop default;
+
+-- Размер файлов для лимита на объем
+-- У старых записей размер неизвестен и остается нулевым: в число загрузок они входят, а в занятый объем - нет
+alter table public.uploads_info
+    add column if not exists size bigint not null default 0;
+
+alter table public.mini_info
+    add column if not exists size bigint not null default 0;
+
+-- Задачи теперь идут в media.<арендатор>.picture
+update public.thumbnail_jobs set subject = 'media.default.picture' where subject = 'media.picture';
+
+update public.outbox set subject = 'media.default.picture' where subject = 'media.picture';
+
+update public.dead_letters set subject = 'media.default.picture' where subject = 'media.picture';
+
+-- Подсчет занятого места арендатора
+create index if not exists uploads_info_tenant_id_idx on public.uploads_info (tenant_id);
+
+create index if not exists mini_info_tenant_id_idx on public.mini_info (tenant_id);
+
+drop index if exists public.webhooks_owner_id_idx;
+
+create index if not exists webhooks_owner_id_idx on public.webhooks (tenant_id, owner_id);
+
+-- Владелец - пара (арендатор, owner_id), индексы из 0013 начинаются с нее
+drop index if exists public.uploads_info_sha256_idx;
+
+create unique index if not exists uploads_info_sha256_idx on public.uploads_info (tenant_id, owner_id, sha256) where duplicate_of is null and deleted_at is null;
+
+drop index if exists public.uploads_info_upload_at_idx;
+
+drop index if exists public.uploads_info_width_idx;
+
+drop index if exists public.uploads_info_height_idx;
+
+drop index if exists public.uploads_info_original_name_idx;
+
+drop index if exists public.uploads_info_original_name_prefix_idx;
+
+drop index if exists public.uploads_info_type_idx;
+
+create index if not exists uploads_info_upload_at_idx on public.uploads_info (tenant_id, owner_id, upload_at, id);
+
+create index if not exists uploads_info_width_idx on public.uploads_info (tenant_id, owner_id, coalesce(width, 0), id);
+
+create index if not exists uploads_info_height_idx on public.uploads_info (tenant_id, owner_id, coalesce(height, 0), id);
+
+create index if not exists uploads_info_original_name_idx on public.uploads_info (tenant_id, owner_id, coalesce(original_name, ''), id);
+
+create index if not exists uploads_info_original_name_prefix_idx on public.uploads_info (tenant_id, owner_id, coalesce(original_name, '') text_pattern_ops);
+
+create index if not exists uploads_info_type_idx on public.uploads_info (tenant_id, owner_id, type);
+
+-- +goose Down
+-- Без арендаторов данные разных арендаторов слились бы у одинаковых owner_id,
+-- а уникальный индекс (owner_id, sha256) не создался бы на совпадающих загрузках - откат запрещен
+-- +goose StatementBegin
+do $$
+begin
+    if (select count(distinct tenant_id)
+        from (select tenant_id from public.uploads_info
+              union select tenant_id from public.api_keys
+              union select tenant_id from public.webhooks) as tenants) > 1 then
+        raise exception 'cannot roll back tenants: data of more than one tenant exists';
+    end if;
+end
+$$;
+-- +goose StatementEnd
+
+drop index if exists public.uploads_info_type_idx;
+
+drop index if exists public.uploads_info_original_name_prefix_idx;
+
+drop index if exists public.uploads_info_original_name_idx;
+
+drop index if exists public.uploads_info_height_idx;
+
+drop index if exists public.uploads_info_width_idx;
+
+drop index if exists public.uploads_info_upload_at_idx;
+
+create index if not exists uploads_info_upload_at_idx on public.uploads_info (owner_id, upload_at, id);
+
+create index if not exists uploads_info_width_idx on public.uploads_info (owner_id, coalesce(width, 0), id);
+
+create index if not exists uploads_info_height_idx on public.uploads_info (owner_id, coalesce(height, 0), id);
+
+create index if not exists uploads_info_original_name_idx on public.uploads_info (owner_id, coalesce(original_name, ''), id);
+
+create index if not exists uploads_info_original_name_prefix_idx on public.uploads_info (owner_id, coalesce(original_name, '') text_pattern_ops);
+
+create index if not exists uploads_info_type_idx on public.uploads_info (owner_id, type);
+
+drop index if exists public.uploads_info_sha256_idx;
+
+create unique index if not exists uploads_info_sha256_idx on public.uploads_info (owner_id, sha256) where duplicate_of is null and deleted_at is null;
+
+drop index if exists public.webhooks_owner_id_idx;
+
+create index if not exists webhooks_owner_id_idx on public.webhooks (owner_id);
+
+drop index if exists public.mini_info_tenant_id_idx;
+
+drop index if exists public.uploads_info_tenant_id_idx;
+
+update public.dead_letters set subject = 'media.picture' where subject like 'media.%.picture';
+
+update public.outbox set subject = 'media.picture' where subject like 'media.%.picture';
+
+update public.thumbnail_jobs set subject = 'media.picture' where subject like 'media.%.picture';
+
+alter table public.mini_info
+    drop column size;
+
+alter table public.uploads_info
+    drop column size;
+
+alter table public.webhooks
+    drop column tenant_id;
+
+alter table public.api_keys
+    drop column tenant_id;
+
+alter table public.mini_info
+    drop column tenant_id;
+
+alter table public.uploads_info
+    drop column tenant_id;
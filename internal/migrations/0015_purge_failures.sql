@@ -0,0 +1,20 @@
+-- +goose Up
+-- Неудачные попытки очистки: загрузка откладывается, чтобы не мешать очистке остальных
+alter table public.uploads_info
+    add column if not exists purge_attempts int not null default 0;
+
+alter table public.uploads_info
+    add column if not exists purge_after timestamp;
+
+alter table public.uploads_info
+    add column if not exists purge_error text;
+
+-- +goose Down
+alter table public.uploads_info
+    drop column purge_error;
+
+alter table public.uploads_info
+    drop column purge_after;
+
+alter table public.uploads_info
+    drop column purge_attempts;
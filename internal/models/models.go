@@ -2,16 +2,60 @@ package models
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	// Запись не найдена
+	ErrNotFound = errors.New("not found")
+	// Операция недопустима в текущем состоянии записи
+	ErrConflict = errors.New("conflict")
+	// Недопустимое имя файла
+	ErrInvalidFileName = errors.New("invalid file name")
+	// Недопустимая позиция страницы
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// Недопустимый адрес или событие вебхука
+	ErrInvalidWebhook = errors.New("invalid webhook")
+	// Ключ не передан, неизвестен или отозван
+	ErrUnauthorized = errors.New("unauthorized")
+	// Недопустимый идентификатор владельца
+	ErrInvalidOwner = errors.New("invalid owner")
+	// Недопустимый идентификатор арендатора
+	ErrInvalidTenant = errors.New("invalid tenant")
+	// Загрузка превысила бы лимит арендатора
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// Действие недоступно вызывающему
+	ErrForbidden = errors.New("forbidden")
+	// Запрос на загрузку некорректен: нет файла, битое тело или неподдерживаемое изображение
+	ErrInvalidUpload = errors.New("invalid upload")
 )
 
 type ImageMeta struct {
-	Name   string
+	// Ключ в хранилище
+	Name string
+	// Имя файла, переданное клиентом
+	OriginalName string
+	// SHA-256 содержимого в hex
+	SHA256 string
 	Type   string
 	Height int
 	Width  int
+	// Размер в байтах
+	Size int64
 }
 
 // Отображение информации о загруженных картинках и созданных миниатюрах
@@ -21,31 +65,543 @@ type AllImages struct {
 	Type       string `json:"type"`
 	Width      int    `json:"width"`
 	Height     int    `json:"height"`
+	Preset     string `json:"preset"`
 	NameMini   string `json:"name_miniature"`
 	WidthMini  int    `json:"width_miniature"`
 	HeightMini int    `json:"height_miniature"`
 }
 
-// Получаем данные о картинке
-func CollectImageMeta(data []byte, name string) (*ImageMeta, error) {
-	// Из байтов декодируем изображение
-	r := bytes.NewReader(data)
-	//r.Seek(0, 0)
-	imageData, imageType, err := image.Decode(r)
+// Пресет миниатюры: имя, граница по наибольшей стороне, формат и качество
+type ThumbnailPreset struct {
+	Name    string `json:"name"`
+	Size    int    `json:"size"`
+	Format  string `json:"format"`
+	Quality int    `json:"quality"`
+}
+
+// Параметры миниатюр, переданные при загрузке
+type ThumbnailOptions struct {
+	// Дополнительный размер, 0 - только пресеты
+	Size int
+	// Формат для всех миниатюр, пусто - формат пресета
+	Format string
+	// Качество для всех миниатюр, 0 - качество пресета
+	Quality int
+}
+
+// Миниатюра, созданная по одному из пресетов
+type Thumbnail struct {
+	Preset string `json:"preset"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// Оригинал со всеми своими миниатюрами
+type UploadInfo struct {
+	ID           uint        `json:"id"`
+	Name         string      `json:"name"`
+	OriginalName string      `json:"original_name"`
+	SHA256       string      `json:"sha256,omitempty"`
+	Type         string      `json:"type"`
+	Width        int         `json:"width"`
+	Height       int         `json:"height"`
+	UploadAt     time.Time   `json:"upload_at"`
+	Thumbnails   []Thumbnail `json:"thumbnails"`
+}
+
+// Поля сортировки списка загрузок
+const (
+	SortUploadAt = "upload_at"
+	SortID       = "id"
+	SortName     = "name"
+	SortWidth    = "width"
+	SortHeight   = "height"
+)
+
+// Фильтры, сортировка и позиция страницы списка загрузок
+type UploadFilter struct {
+	Type       string
+	NamePrefix string
+	MinWidth   int
+	MaxWidth   int
+	MinHeight  int
+	MaxHeight  int
+	// Диапазон даты загрузки [From, To), нулевое время - без ограничения
+	From time.Time
+	To   time.Time
+	// Поле сортировки, по умолчанию upload_at
+	Sort string
+	Desc bool
+	// Непрозрачная позиция, с которой продолжить, из NextCursor предыдущей страницы
+	Cursor string
+	Limit  int
+}
+
+// Страница списка загрузок
+type UploadPage struct {
+	Items []UploadInfo `json:"items"`
+	// Всего записей под фильтрами, без учета страницы
+	Total int `json:"total"`
+	// Пусто - страница последняя
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Задача на миниатюру, созданная при загрузке
+type UploadJob struct {
+	ID     int    `json:"id"`
+	Preset string `json:"preset"`
+}
+
+// Загрузка, записанная в БД: новая или уже существующая с тем же содержимым
+type SavedUpload struct {
+	ID      int
+	Created bool
+	// Задачи на миниатюры, только для новой загрузки
+	Jobs []UploadJob
+}
+
+// Результат загрузки: новая запись или уже существующая с тем же содержимым
+type UploadResult struct {
+	UploadID  int         `json:"upload_id"`
+	Duplicate bool        `json:"duplicate"`
+	Jobs      []UploadJob `json:"jobs"`
+	Upload    *UploadInfo `json:"upload"`
+}
+
+// Состояние задачи на миниатюру
+type ThumbnailJob struct {
+	ID       int    `json:"id"`
+	UploadID int    `json:"upload_id"`
+	Preset   string `json:"preset"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// Ошибка последней неудачной попытки
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Начало последней попытки
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// Завершение, для выполненных и неудачных задач
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Похожее изображение и расстояние Хэмминга между перцептивными хэшами
+type SimilarImage struct {
+	ID           uint   `json:"id"`
+	Name         string `json:"name"`
+	OriginalName string `json:"original_name"`
+	Type         string `json:"type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Distance     int    `json:"distance"`
+}
+
+// Удаленная загрузка, окно восстановления которой истекло
+type ExpiredUpload struct {
+	ID int
+	// Оригинал и миниатюры в хранилище
+	Files []string
+}
+
+// Сведения об объекте в хранилище
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Файл изображения для отдачи клиенту
+type ImageFile struct {
+	Name        string
+	ContentType string
+	Size        int64
+	ModTime     time.Time
+	// Неизменяемый файл можно кешировать без перепроверки
+	Immutable bool
+	Content   io.ReadSeekCloser
+}
+
+// Получаем данные о картинке, читая только заголовок
+// Возвращаемый reader отдает изображение целиком, включая уже прочитанный заголовок
+func ReadImageMeta(r io.Reader, name string) (*ImageMeta, io.Reader, error) {
+	// Запоминаем байты, которые прочитает DecodeConfig
+	head := new(bytes.Buffer)
+	config, imageType, err := image.DecodeConfig(io.TeeReader(r, head))
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidUpload, err)
 	}
 
-	b := imageData.Bounds()
+	// Ключ в хранилище назначает сервис, имя клиента сохраняем как есть
 	return &ImageMeta{
-		Name:   name,
-		Type:   imageType,
-		Height: b.Max.Y,
-		Width:  b.Max.X,
-	}, nil
+		OriginalName: name,
+		Type:         imageType,
+		Height:       config.Height,
+		Width:        config.Width,
+	}, io.MultiReader(head, r), nil
+}
+
+// Проверяем имя файла от клиента: без разделителей пути и управляющих символов
+func ValidateFileName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 500 || !utf8.ValidString(name) {
+		return ErrInvalidFileName
+	}
+	for _, r := range name {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return ErrInvalidFileName
+		}
+	}
+
+	return nil
 }
 
+// Статусы задачи на создание миниатюры
+const (
+	JobStatusPending    = "pending"
+	JobStatusProcessing = "processing"
+	JobStatusDone       = "done"
+	JobStatusFailed     = "failed"
+	// Загрузка удалена до того, как задача была выполнена
+	JobStatusCancelled = "cancelled"
+)
+
 type InfoForThumbnail struct {
-	Path string `json:"path"`
-	Size int    `json:"size"`
+	// Имя оригинала в хранилище
+	Name string `json:"name"`
+	// Путь к оригиналу на диске, был в сообщениях до появления Name
+	Path     string `json:"path,omitempty"`
+	Size     int    `json:"size"`
+	Preset   string `json:"preset"`
+	Format   string `json:"format"`
+	Quality  int    `json:"quality"`
+	UploadID int    `json:"upload_id"`
+	JobID    int    `json:"job_id"`
+	// Арендатор загрузки, в старых сообщениях его нет - DefaultTenant
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Задача из очереди вместе с сообщением для подтверждения
+type Task struct {
+	Info *InfoForThumbnail
+	Msg  jetstream.Msg
+}
+
+// Темы Nats
+const (
+	// Задачи на создание миниатюр, media.<арендатор>.picture
+	SubjectPictureAll = "media.*.picture"
+	// Задачи, отправленные до появления арендаторов
+	SubjectPictureLegacy = "media.picture"
+	// Недоставленные задачи, media.dlq.<тема исходной задачи без "media.">
+	SubjectDeadLetterPrefix = "media.dlq."
+	// Недоставленные задачи всех арендаторов
+	// Фильтр media.dlq.> пересекся бы с media.*.picture, а в WorkQueue-потоке фильтры получателей не должны пересекаться
+	SubjectDeadLetterAll = "media.dlq.*.picture"
+	// События о ходе обработки, media.events.<id загрузки>
+	// Идут через обычный Nats, не JetStream: пропущенное событие не страшно, состояние есть в БД
+	SubjectEventPrefix = "media.events."
+)
+
+// Тема задач на миниатюры арендатора
+func PictureSubject(tenant string) string {
+	return "media." + tenant + ".picture"
+}
+
+// Тема задачи с арендатором, задачи из media.picture принадлежат DefaultTenant
+func TenantPictureSubject(subject string) string {
+	if subject == SubjectPictureLegacy {
+		return PictureSubject(DefaultTenant)
+	}
+	return subject
+}
+
+// Тема недоставленной задачи
+func DeadLetterSubject(subject string) string {
+	return SubjectDeadLetterPrefix + strings.TrimPrefix(TenantPictureSubject(subject), "media.")
+}
+
+// Тема событий загрузки
+func EventSubject(uploadID int) string {
+	return SubjectEventPrefix + strconv.Itoa(uploadID)
+}
+
+// Событие о смене состояния задачи на миниатюру
+type ThumbnailEvent struct {
+	UploadID int    `json:"upload_id"`
+	JobID    int    `json:"job_id"`
+	Preset   string `json:"preset"`
+	// Новый статус задачи
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Созданная миниатюра, только для статуса done
+	Thumbnail *Thumbnail `json:"thumbnail,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+// Заголовки сообщений в очереди недоставленных задач
+const (
+	HeaderDeadLetterError    = "Dlq-Error"
+	HeaderDeadLetterAttempts = "Dlq-Attempts"
+	HeaderDeadLetterSubject  = "Dlq-Subject"
+)
+
+// Сообщение, ожидающее отправки в Nats
+type OutboxMessage struct {
+	ID      int64
+	Subject string
+	// Идентификатор для дедупликации в JetStream (Nats-Msg-Id)
+	MsgID   string
+	Payload []byte
+}
+
+// Формирует сообщение в Nats для созданной задачи на генерацию миниатюры
+type OutboxBuilder func(uploadID int, jobID int, preset ThumbnailPreset) (*OutboxMessage, error)
+
+// Статусы записи в очереди недоставленных сообщений
+const (
+	DeadLetterStatusDead      = "dead"
+	DeadLetterStatusRetried   = "retried"
+	DeadLetterStatusDiscarded = "discarded"
+)
+
+// Задача, которую не удалось обработать за все попытки
+type DeadLetter struct {
+	ID        int       `json:"id"`
+	StreamSeq uint64    `json:"stream_seq"`
+	JobID     int       `json:"job_id"`
+	UploadID  int       `json:"upload_id"`
+	Subject   string    `json:"subject"`
+	Payload   string    `json:"payload"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// События для вебхуков
+const (
+	WebhookEventUploadCreated    = "upload.created"
+	WebhookEventUploadDeleted    = "upload.deleted"
+	WebhookEventThumbnailCreated = "thumbnail.created"
+	WebhookEventThumbnailFailed  = "thumbnail.failed"
+)
+
+// Все события, на которые можно подписать вебхук
+var WebhookEvents = []string{
+	WebhookEventUploadCreated,
+	WebhookEventUploadDeleted,
+	WebhookEventThumbnailCreated,
+	WebhookEventThumbnailFailed,
+}
+
+// Статусы доставки вебхука
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// Зарегистрированный получатель событий
+type Webhook struct {
+	ID       int    `json:"id"`
+	TenantID string `json:"tenant_id"`
+	OwnerID  string `json:"owner_id"`
+	URL      string `json:"url"`
+	// Отдается только при создании
+	Secret string `json:"secret,omitempty"`
+	// Пустой список - все события
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Тело запроса к вебхуку
+type WebhookEvent struct {
+	Event     string      `json:"event"`
+	UploadID  int         `json:"upload_id"`
+	JobID     int         `json:"job_id,omitempty"`
+	Preset    string      `json:"preset,omitempty"`
+	Upload    *UploadInfo `json:"upload,omitempty"`
+	Thumbnail *Thumbnail  `json:"thumbnail,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Time      time.Time   `json:"time"`
+}
+
+// Запись журнала доставки вебхука
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode *int            `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	// Куда и с каким ключом отправлять, заполняется для отправки
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// Владелец загрузок, для которых не задан другой
+const LegacyOwner = "legacy"
+
+// API ключ, сам ключ отдается только при создании
+type APIKey struct {
+	ID       int    `json:"id"`
+	TenantID string `json:"tenant_id"`
+	OwnerID  string `json:"owner_id"`
+	Name     string `json:"name"`
+	// Начало ключа, чтобы отличать ключи в списке
+	Prefix    string     `json:"prefix"`
+	Key       string     `json:"key,omitempty"`
+	Admin     bool       `json:"admin"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// SHA-256 ключа в hex, хранится вместо ключа
+	Hash string `json:"-"`
+}
+
+// Права доступа
+const (
+	// Чтение своих загрузок, задач и вебхуков
+	ScopeUploadsRead = "uploads:read"
+	// Загрузка, удаление и восстановление, управление своими вебхуками
+	ScopeUploadsWrite = "uploads:write"
+	// Управление ключами и недоставленными задачами
+	ScopeAdmin = "admin"
+)
+
+// Проверенный вызывающий: все загрузки и вебхуки видны только своему владельцу
+type Principal struct {
+	TenantID string
+	OwnerID  string
+	Scopes   []string
+	// Оператор из конфигурации: управляет ключами и недоставленными задачами всех арендаторов
+	Operator bool
+}
+
+// Владелец загрузок и вебхуков, одинаковые owner_id разных арендаторов - разные владельцы
+type Owner struct {
+	TenantID string
+	OwnerID  string
+}
+
+// Есть ли у вызывающего право
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// Запоминаем вызывающего в контексте запроса
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Получаем вызывающего из контекста запроса
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
+
+// Владелец из контекста запроса, ErrUnauthorized - запрос не прошел проверку ключа
+func OwnerFromContext(ctx context.Context) (Owner, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || principal.OwnerID == "" || principal.TenantID == "" {
+		return Owner{}, ErrUnauthorized
+	}
+
+	return Owner{TenantID: principal.TenantID, OwnerID: principal.OwnerID}, nil
+}
+
+// Арендатор, ключами и недоставленными задачами которого управляет вызывающий
+// Пустая строка - оператор, ему доступны все арендаторы
+func TenantScope(ctx context.Context) (string, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return "", ErrUnauthorized
+	}
+	if principal.Operator {
+		return "", nil
+	}
+	if principal.TenantID == "" {
+		return "", ErrUnauthorized
+	}
+
+	return principal.TenantID, nil
+}
+
+// Арендатор, которому принадлежат данные, созданные до появления арендаторов
+const DefaultTenant = "default"
+
+// Имена, занятые служебными темами media.dlq.> и media.events.>
+var reservedTenants = map[string]struct{}{"dlq": {}, "events": {}}
+
+// Проверяем идентификатор арендатора: он входит в темы Nats и ключи хранилища,
+// поэтому только строчные латинские буквы, цифры, '-' и '_', не длиннее 63 символов
+func ValidateTenant(tenant string) error {
+	if tenant == "" || len(tenant) > 63 {
+		return ErrInvalidTenant
+	}
+	for i, r := range tenant {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case (r == '-' || r == '_') && i > 0:
+		default:
+			return ErrInvalidTenant
+		}
+	}
+	if _, ok := reservedTenants[tenant]; ok {
+		return ErrInvalidTenant
+	}
+
+	return nil
+}
+
+// Ключ объекта в хранилище с префиксом арендатора
+func TenantObjectName(tenant string, name string) string {
+	return tenant + "/" + name
+}
+
+// Лимиты арендатора, 0 - без ограничений
+type Quota struct {
+	MaxBytes  int64 `json:"max_bytes"`
+	MaxImages int   `json:"max_images"`
+}
+
+// Превысят ли лимит еще images изображений на bytes байт
+func (q Quota) Exceeded(usage TenantUsage, images int, bytes int64) bool {
+	return (q.MaxImages > 0 && usage.Images+images > q.MaxImages) || (q.MaxBytes > 0 && usage.Bytes+bytes > q.MaxBytes)
+}
+
+// Лимиты по умолчанию и отдельных арендаторов
+type QuotaPolicy struct {
+	Default Quota
+	Tenants map[string]Quota
+}
+
+// Лимиты арендатора
+func (p QuotaPolicy) For(tenant string) Quota {
+	if quota, ok := p.Tenants[tenant]; ok {
+		return quota
+	}
+	return p.Default
+}
+
+// Занятое арендатором место: оригиналы и миниатюры, включая удаленные, но еще не очищенные
+type TenantUsage struct {
+	TenantID string `json:"tenant_id"`
+	Images   int    `json:"images"`
+	Bytes    int64  `json:"bytes"`
+	Quota    Quota  `json:"quota"`
 }
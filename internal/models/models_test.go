@@ -0,0 +1,96 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTenant(t *testing.T) {
+	tests := []struct {
+		tenant string
+		valid  bool
+	}{
+		{"default", true},
+		{"acme", true},
+		{"acme-corp_2", true},
+		{"0", true},
+		{strings.Repeat("a", 63), true},
+		{"", false},
+		{strings.Repeat("a", 64), false},
+		{"Acme", false},
+		{"-acme", false},
+		{"_acme", false},
+		{"ac.me", false},
+		{"ac/me", false},
+		{"ac*me", false},
+		{"ac me", false},
+		{"acmé", false},
+		// Заняты служебными темами Nats
+		{"dlq", false},
+		{"events", false},
+		{"dlq2", true},
+	}
+	for _, tt := range tests {
+		err := ValidateTenant(tt.tenant)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateTenant(%q) = %v, want valid %v", tt.tenant, err, tt.valid)
+		}
+		if err != nil && err != ErrInvalidTenant {
+			t.Errorf("ValidateTenant(%q) = %v, want ErrInvalidTenant", tt.tenant, err)
+		}
+	}
+}
+
+func TestQuotaPolicyFor(t *testing.T) {
+	policy := QuotaPolicy{
+		Default: Quota{MaxBytes: 100, MaxImages: 10},
+		Tenants: map[string]Quota{"acme": {MaxBytes: 1000}, "free": {}},
+	}
+
+	tests := []struct {
+		tenant string
+		want   Quota
+	}{
+		{"acme", Quota{MaxBytes: 1000}},
+		// Нулевые лимиты арендатора - без ограничений, а не лимиты по умолчанию
+		{"free", Quota{}},
+		{"other", Quota{MaxBytes: 100, MaxImages: 10}},
+		{DefaultTenant, Quota{MaxBytes: 100, MaxImages: 10}},
+	}
+	for _, tt := range tests {
+		if got := policy.For(tt.tenant); got != tt.want {
+			t.Errorf("For(%q) = %+v, want %+v", tt.tenant, got, tt.want)
+		}
+	}
+
+	if got := (QuotaPolicy{}).For("acme"); got != (Quota{}) {
+		t.Errorf("empty policy For = %+v, want no limits", got)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	tests := []struct {
+		name   string
+		quota  Quota
+		usage  TenantUsage
+		images int
+		bytes  int64
+		want   bool
+	}{
+		{"no limits", Quota{}, TenantUsage{Images: 1 << 20, Bytes: 1 << 40}, 1, 1 << 30, false},
+		{"below both", Quota{MaxBytes: 100, MaxImages: 10}, TenantUsage{Images: 5, Bytes: 50}, 1, 10, false},
+		{"reaches bytes", Quota{MaxBytes: 100}, TenantUsage{Bytes: 90}, 1, 10, false},
+		{"above bytes", Quota{MaxBytes: 100}, TenantUsage{Bytes: 90}, 1, 11, true},
+		{"reaches images", Quota{MaxImages: 10}, TenantUsage{Images: 9}, 1, 1 << 30, false},
+		{"above images", Quota{MaxImages: 10}, TenantUsage{Images: 10}, 1, 0, true},
+		{"images only limit", Quota{MaxImages: 10}, TenantUsage{Images: 3, Bytes: 1 << 40}, 1, 1, false},
+		{"bytes only limit", Quota{MaxBytes: 100}, TenantUsage{Images: 1 << 20}, 1, 1, false},
+		// Проверка без новой загрузки: лимит уже превышен
+		{"already over", Quota{MaxBytes: 100}, TenantUsage{Bytes: 101}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		if got := tt.quota.Exceeded(tt.usage, tt.images, tt.bytes); got != tt.want {
+			t.Errorf("%s: Exceeded = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
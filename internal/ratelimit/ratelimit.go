@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Как часто убирать корзины, которые успели наполниться
+const sweepInterval = time.Minute
+
+type Limiter interface {
+	// Можно ли выполнить запрос с ключом key, иначе - через сколько появится токен
+	Allow(key string) (bool, time.Duration)
+}
+
+// Корзина токенов одного ключа
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token bucket на каждый ключ: rate токенов в секунду, не больше burst в запасе
+type limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	// Часы, в тестах подменяются
+	now func() time.Time
+}
+
+// Можно ли выполнить запрос с ключом key, иначе - через сколько появится токен
+func (l *limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = l.refill(b, now)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Токены в корзине к моменту now
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// Полная корзина ничем не отличается от новой, поэтому ее можно забыть
+// Иначе карта росла бы с каждым новым ключом или IP
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rate - токенов в секунду, burst - сколько запросов можно сделать подряд
+func New(rate float64, burst int) Limiter {
+	return newLimiter(rate, burst, time.Now)
+}
+
+func newLimiter(rate float64, burst int, now func() time.Time) *limiter {
+	return &limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: now(),
+		now:       now,
+	}
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// Часы, которые двигаются только вручную
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestLimiter(rate float64, burst int) (*limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return newLimiter(rate, burst, clock.now), clock
+}
+
+func TestAllowBurst(t *testing.T) {
+	l, _ := newTestLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, wait := l.Allow("a"); !ok || wait != 0 {
+			t.Fatalf("request %d: Allow = %v, %v, want true, 0", i, ok, wait)
+		}
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("request above burst allowed")
+	}
+	// У другого ключа своя корзина
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("other key limited")
+	}
+}
+
+func TestAllowRetryAfter(t *testing.T) {
+	l, clock := newTestLimiter(2, 1)
+
+	l.Allow("a")
+	if ok, wait := l.Allow("a"); ok || wait != 500*time.Millisecond {
+		t.Fatalf("Allow = %v, %v, want false, 500ms", ok, wait)
+	}
+
+	// Отказ не тратит токен: через четверть секунды ждать осталось столько же
+	clock.advance(250 * time.Millisecond)
+	if ok, wait := l.Allow("a"); ok || wait != 250*time.Millisecond {
+		t.Fatalf("Allow = %v, %v, want false, 250ms", ok, wait)
+	}
+}
+
+func TestAllowRefill(t *testing.T) {
+	l, clock := newTestLimiter(2, 2)
+
+	l.Allow("a")
+	l.Allow("a")
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("empty bucket allowed")
+	}
+
+	clock.advance(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("token not refilled after 1/rate")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("refilled more than one token")
+	}
+
+	// Долгий простой наполняет корзину не больше burst
+	clock.advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d after idle limited", i)
+		}
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("bucket refilled above burst")
+	}
+}
+
+func TestSweepEvictsFullBuckets(t *testing.T) {
+	l, clock := newTestLimiter(1, 10)
+
+	l.Allow("idle")
+	clock.advance(sweepInterval - time.Second)
+	for i := 0; i < 10; i++ {
+		l.Allow("busy")
+	}
+
+	// К очистке "idle" успела наполниться, а "busy" - нет
+	clock.advance(time.Second)
+	l.Allow("other")
+	if _, ok := l.buckets["idle"]; ok {
+		t.Fatal("full bucket not evicted")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Fatal("partly used bucket evicted")
+	}
+
+	// До следующего интервала очистки даже полные корзины остаются
+	clock.advance(sweepInterval / 2)
+	l.Allow("current")
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Fatal("bucket evicted before sweep interval")
+	}
+
+	clock.advance(sweepInterval / 2)
+	l.Allow("current")
+	if len(l.buckets) != 1 {
+		t.Fatalf("buckets = %d, want only the current key", len(l.buckets))
+	}
+}
@@ -0,0 +1,330 @@
+package auth_service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+)
+
+// Неизвестный kid перечитывает JWKS не чаще, чем раз в минуту,
+// чтобы поток токенов с чужими kid не превратился в поток запросов к провайдеру
+const minJWKSRefresh = time.Minute
+
+// Максимальный размер JWKS
+const maxJWKSSize = 1 << 20
+
+// Настройки проверки JWT
+type JWTConfig struct {
+	// Путь к файлу JWKS или его адрес http(s)://
+	JWKS string
+	// Пустые значения не проверяются
+	Issuer   string
+	Audience string
+	// Claim с владельцем и claim с правами (строка через пробел или массив)
+	OwnerClaim string
+	ScopeClaim string
+	// Claim с арендатором, без него - DefaultTenant
+	TenantClaim string
+	// Допустимое расхождение часов
+	Leeway time.Duration
+	// Как долго доверять загруженным ключам, прежде чем перечитать JWKS
+	Refresh time.Duration
+}
+
+// Проверка RS256/ES256 токенов по ключам из JWKS
+type jwtVerifier struct {
+	log    zerolog.Logger
+	cfg    JWTConfig
+	parser *jwt.Parser
+	client *http.Client
+	// Одновременные перечитывания JWKS сводятся к одному запросу
+	reloads singleflight.Group
+
+	mu       sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+// Проверяем подпись, срок, издателя и получателя токена и получаем вызывающего
+func (v *jwtVerifier) Verify(ctx context.Context, raw string) (*models.Principal, error) {
+	token, err := v.parser.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		return v.key(ctx, token)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(models.ErrUnauthorized, "invalid token: %v", err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.Wrap(models.ErrUnauthorized, "unexpected token claims")
+	}
+	owner, _ := claims[v.cfg.OwnerClaim].(string)
+	if owner == "" || len(owner) > maxOwnerLen {
+		return nil, errors.Wrapf(models.ErrUnauthorized, "token has no valid %q claim", v.cfg.OwnerClaim)
+	}
+
+	tenant := models.DefaultTenant
+	if value, ok := claims[v.cfg.TenantClaim]; ok {
+		tenant, _ = value.(string)
+		if err = models.ValidateTenant(tenant); err != nil {
+			return nil, errors.Wrapf(models.ErrUnauthorized, "token has no valid %q claim", v.cfg.TenantClaim)
+		}
+	}
+
+	return &models.Principal{TenantID: tenant, OwnerID: owner, Scopes: parseScopes(claims[v.cfg.ScopeClaim])}, nil
+}
+
+// Права из claim: "a b c" (RFC 8693) или ["a", "b", "c"]
+func parseScopes(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		scopes := make([]string, 0, len(value))
+		for _, item := range value {
+			if scope, ok := item.(string); ok {
+				scopes = append(scopes, scope)
+			}
+		}
+		return scopes
+	default:
+		return nil
+	}
+}
+
+// Ключ для токена по kid, без kid подходит единственный ключ набора
+// Устаревший набор или неизвестный kid перечитывают JWKS - так подхватывается смена ключей у провайдера
+func (v *jwtVerifier) key(ctx context.Context, token *jwt.Token) (crypto.PublicKey, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok, age := v.lookup(kid)
+	if age >= v.cfg.Refresh || (!ok && age >= minJWKSRefresh) {
+		if err := v.refresh(ctx); err != nil {
+			// Провайдер недоступен - работаем со старым набором
+			v.log.Error().Err(err).Msg("failed to refresh jwks")
+		} else {
+			key, ok, _ = v.lookup(kid)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// Ключ из текущего набора и возраст набора
+func (v *jwtVerifier) lookup(kid string) (crypto.PublicKey, bool, time.Duration) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	age := time.Since(v.loadedAt)
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true, age
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok, age
+}
+
+// Перечитываем JWKS одной загрузкой на всех ожидающих
+// Загрузка не зависит от контекста запроса: отмена одного запроса не должна сорвать ее остальным
+func (v *jwtVerifier) refresh(ctx context.Context) error {
+	result := v.reloads.DoChan("jwks", func() (interface{}, error) {
+		return nil, v.reload(context.Background())
+	})
+
+	select {
+	case res := <-result:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Загружаем набор ключей без блокировки и подменяем его под mu
+func (v *jwtVerifier) reload(ctx context.Context) error {
+	data, err := v.readJWKS(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.loadedAt = time.Now()
+	v.mu.Unlock()
+	v.log.Info().Int("keys", len(keys)).Str("jwks", v.cfg.JWKS).Msg("jwks loaded")
+
+	return nil
+}
+
+func (v *jwtVerifier) readJWKS(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(v.cfg.JWKS, "http://") && !strings.HasPrefix(v.cfg.JWKS, "https://") {
+		data, err := os.ReadFile(v.cfg.JWKS)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read jwks file")
+		}
+		return data, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKS, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create jwks request")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch jwks")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks: unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read jwks")
+	}
+
+	return data, nil
+}
+
+// Ключ из JWKS (RFC 7517), нужны только поля RSA и EC
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Разбираем JWKS: RSA не короче 2048 бит для RS256 и EC P-256 для ES256
+// Ключи шифрования и неподдерживаемые ключи пропускаем
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(err, "failed to parse jwks")
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid jwks key %q", jwk.Kid)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no RSA or P-256 signing keys")
+	}
+
+	return keys, nil
+}
+
+// Открытый ключ, nil - тип ключа не поддерживается
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported rsa key size or exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		curve := elliptic.P256()
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Загружаем JWKS сразу, чтобы ошибка в настройках была видна при запуске
+func NewJWTVerifier(log zerolog.Logger, cfg JWTConfig) (TokenVerifier, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithLeeway(cfg.Leeway),
+		jwt.WithExpirationRequired(),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	v := &jwtVerifier{
+		log:    log,
+		cfg:    cfg,
+		parser: jwt.NewParser(opts...),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := v.reload(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
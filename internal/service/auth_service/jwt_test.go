@@ -0,0 +1,293 @@
+package auth_service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "media-api"
+)
+
+// Ключи провайдера для подписи тестовых токенов
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+func b64(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// JWKS с открытыми ключами: RSA под kid rsaKid, EC под kid "ec"
+func (k testKeys) jwks(t *testing.T, rsaKid string) []byte {
+	t.Helper()
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": rsaKid, "use": "sig", "n": b64(k.rsa.N), "e": b64(big.NewInt(int64(k.rsa.E)))},
+			{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256", "x": b64(k.ec.X), "y": b64(k.ec.Y)},
+		},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testConfig(jwks string) JWTConfig {
+	return JWTConfig{
+		JWKS:        jwks,
+		Issuer:      testIssuer,
+		Audience:    testAudience,
+		OwnerClaim:  "sub",
+		ScopeClaim:  "scope",
+		TenantClaim: "tenant",
+		Refresh:     time.Hour,
+	}
+}
+
+func newTestVerifier(t *testing.T, keys testKeys) TokenVerifier {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keys.jwks(t, "rsa"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewJWTVerifier(zerolog.Nop(), testConfig(path))
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+	return verifier
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":    testIssuer,
+		"aud":    testAudience,
+		"sub":    "alice",
+		"tenant": "acme",
+		"scope":  "uploads:read uploads:write",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestJWTVerifyValidTokens(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier := newTestVerifier(t, keys)
+
+	for name, token := range map[string]string{
+		"RS256": sign(t, jwt.SigningMethodRS256, "rsa", validClaims(), keys.rsa),
+		"ES256": sign(t, jwt.SigningMethodES256, "ec", validClaims(), keys.ec),
+	} {
+		principal, err := verifier.Verify(context.Background(), token)
+		if err != nil {
+			t.Errorf("%s: Verify: %v", name, err)
+			continue
+		}
+		if principal.TenantID != "acme" || principal.OwnerID != "alice" {
+			t.Errorf("%s: principal = %s/%s, want acme/alice", name, principal.TenantID, principal.OwnerID)
+		}
+		if !principal.HasScope(models.ScopeUploadsWrite) || principal.HasScope(models.ScopeAdmin) {
+			t.Errorf("%s: scopes = %v", name, principal.Scopes)
+		}
+	}
+}
+
+func TestJWTVerifyRejectsInvalidTokens(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier := newTestVerifier(t, keys)
+
+	with := func(key string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"alg none":          sign(t, jwt.SigningMethodNone, "rsa", validClaims(), jwt.UnsafeAllowNoneSignatureType),
+		"HS256 with public": sign(t, jwt.SigningMethodHS256, "rsa", validClaims(), publicDER),
+		"expired":           sign(t, jwt.SigningMethodRS256, "rsa", with("exp", time.Now().Add(-time.Hour).Unix()), keys.rsa),
+		"missing exp":       sign(t, jwt.SigningMethodRS256, "rsa", with("exp", nil), keys.rsa),
+		"wrong issuer":      sign(t, jwt.SigningMethodRS256, "rsa", with("iss", "https://evil.example.com"), keys.rsa),
+		"wrong audience":    sign(t, jwt.SigningMethodRS256, "rsa", with("aud", "other-api"), keys.rsa),
+		"unknown kid":       sign(t, jwt.SigningMethodRS256, "other", validClaims(), keys.rsa),
+		"wrong key for kid": sign(t, jwt.SigningMethodES256, "ec", validClaims(), mustECKey(t)),
+		"missing owner":     sign(t, jwt.SigningMethodRS256, "rsa", with("sub", nil), keys.rsa),
+		"reserved tenant":   sign(t, jwt.SigningMethodRS256, "rsa", with("tenant", "dlq"), keys.rsa),
+	}
+	for name, token := range tests {
+		if _, err := verifier.Verify(context.Background(), token); !errors.Is(err, models.ErrUnauthorized) {
+			t.Errorf("%s: Verify error = %v, want ErrUnauthorized", name, err)
+		}
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Права из токена: строка через пробел или массив строк
+func TestJWTScopes(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier := newTestVerifier(t, keys)
+
+	array := validClaims()
+	array["scope"] = []interface{}{"uploads:write", 42}
+	readOnly := validClaims()
+	readOnly["scope"] = "uploads:read"
+	missing := validClaims()
+	delete(missing, "scope")
+
+	tests := []struct {
+		name   string
+		token  string
+		scopes []string
+	}{
+		{"space separated", sign(t, jwt.SigningMethodRS256, "rsa", validClaims(), keys.rsa), []string{models.ScopeUploadsRead, models.ScopeUploadsWrite}},
+		{"array", sign(t, jwt.SigningMethodES256, "ec", array, keys.ec), []string{models.ScopeUploadsWrite}},
+		{"read only", sign(t, jwt.SigningMethodRS256, "rsa", readOnly, keys.rsa), []string{models.ScopeUploadsRead}},
+		{"missing", sign(t, jwt.SigningMethodRS256, "rsa", missing, keys.rsa), nil},
+	}
+	for _, tt := range tests {
+		principal, err := verifier.Verify(context.Background(), tt.token)
+		if err != nil {
+			t.Errorf("%s: Verify: %v", tt.name, err)
+			continue
+		}
+		if len(principal.Scopes) != len(tt.scopes) {
+			t.Errorf("%s: scopes = %v, want %v", tt.name, principal.Scopes, tt.scopes)
+			continue
+		}
+		for _, scope := range tt.scopes {
+			if !principal.HasScope(scope) {
+				t.Errorf("%s: scopes = %v, want %v", tt.name, principal.Scopes, tt.scopes)
+			}
+		}
+	}
+}
+
+// Одновременные запросы с новым kid перечитывают JWKS один раз и не держат блокировку во время загрузки
+func TestJWTReloadIsShared(t *testing.T) {
+	oldKeys, newKeys := newTestKeys(t), newTestKeys(t)
+	oldJWKS, newJWKS := oldKeys.jwks(t, "rsa"), newKeys.jwks(t, "rsa-2")
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			w.Write(oldJWKS)
+			return
+		}
+		<-release
+		w.Write(newJWKS)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	verifier, err := NewJWTVerifier(zerolog.Nop(), cfg)
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+	v := verifier.(*jwtVerifier)
+	// Набор загружен давно, поэтому неизвестный kid его перечитывает
+	v.mu.Lock()
+	v.loadedAt = time.Now().Add(-minJWKSRefresh)
+	v.mu.Unlock()
+
+	rotated := sign(t, jwt.SigningMethodRS256, "rsa-2", validClaims(), newKeys.rsa)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.Verify(context.Background(), rotated)
+			errs <- err
+		}()
+	}
+
+	// Пока JWKS загружается, набор ключей доступен для чтения
+	time.Sleep(50 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		v.lookup("rsa")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("key set is locked while jwks is being fetched")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Verify after rotation: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("jwks fetched %d times, want 2", n)
+	}
+}
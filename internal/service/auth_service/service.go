@@ -0,0 +1,189 @@
+package auth_service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Все ключи начинаются с этого префикса, чтобы их было легко найти в логах и конфигах
+const KeyPrefix = "mk_"
+
+// Сколько символов ключа хранить открыто для списка ключей
+const visiblePrefixLen = len(KeyPrefix) + 8
+
+// Максимальная длина идентификатора владельца, как в БД
+const maxOwnerLen = 255
+
+type Storage interface {
+	// Сохраняем API ключ, хранится только хэш
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	// Ищем действующий ключ по хэшу
+	GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error)
+	// Получаем ключи арендатора, включая отозванные, пустой арендатор - все
+	GetAPIKeys(ctx context.Context, tenant string) ([]models.APIKey, error)
+	// Отзываем ключ арендатора, пустой арендатор - любой
+	RevokeAPIKey(ctx context.Context, tenant string, id int) error
+}
+
+type AuthService interface {
+	// Проверяем API ключ или JWT и получаем вызывающего, ErrUnauthorized - проверка не пройдена
+	Authenticate(ctx context.Context, credential string) (*models.Principal, error)
+	// Выпускаем ключ для арендатора вызывающего, сам ключ возвращается в key.Key только здесь
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	// Получаем ключи арендатора вызывающего без самих ключей
+	GetAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	// Отзываем ключ арендатора вызывающего
+	RevokeAPIKey(ctx context.Context, id int) error
+}
+
+// Проверка токенов, выпущенных внешним провайдером
+type TokenVerifier interface {
+	// Проверяем подпись и срок токена и получаем вызывающего
+	Verify(ctx context.Context, token string) (*models.Principal, error)
+}
+
+// Права ключей: обычный ключ работает со своими загрузками, ключ администратора - со всем в своем арендаторе
+var (
+	keyScopes   = []string{models.ScopeUploadsRead, models.ScopeUploadsWrite}
+	adminScopes = []string{models.ScopeUploadsRead, models.ScopeUploadsWrite, models.ScopeAdmin}
+)
+
+type authService struct {
+	log     zerolog.Logger
+	storage Storage
+	// nil - JWT не принимаются
+	tokens TokenVerifier
+	// Хэш ключа администратора из конфигурации, пустой - такого ключа нет
+	adminHash   string
+	adminTenant string
+	adminOwner  string
+}
+
+// Проверяем API ключ или JWT и получаем вызывающего
+// API ключи отличаются по префиксу, все остальное считается JWT
+func (a *authService) Authenticate(ctx context.Context, credential string) (*models.Principal, error) {
+	if !strings.HasPrefix(credential, KeyPrefix) {
+		if a.tokens == nil {
+			return nil, models.ErrUnauthorized
+		}
+		return a.tokens.Verify(ctx, credential)
+	}
+	hash := hashKey(credential)
+
+	// Ключ из конфигурации в БД не хранится, только он управляет всеми арендаторами
+	if a.adminHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.adminHash)) == 1 {
+		return &models.Principal{TenantID: a.adminTenant, OwnerID: a.adminOwner, Scopes: adminScopes, Operator: true}, nil
+	}
+
+	apiKey, err := a.storage.GetAPIKeyByHash(ctx, hash)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return nil, models.ErrUnauthorized
+		}
+		return nil, err
+	}
+
+	scopes := keyScopes
+	if apiKey.Admin {
+		scopes = adminScopes
+	}
+
+	return &models.Principal{TenantID: apiKey.TenantID, OwnerID: apiKey.OwnerID, Scopes: scopes}, nil
+}
+
+// Выпускаем ключ: 32 случайных байта в hex, в БД попадает только SHA-256
+// Ключи длинные и случайные, поэтому медленный хэш вроде bcrypt не нужен
+// Ключ без арендатора выпускается для арендатора вызывающего, у оператора - для DefaultTenant
+// Ключи других арендаторов выпускает только оператор, иначе ErrForbidden
+func (a *authService) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	tenant, err := models.TenantScope(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case key.TenantID == "" && tenant == "":
+		key.TenantID = models.DefaultTenant
+	case key.TenantID == "":
+		key.TenantID = tenant
+	case tenant != "" && key.TenantID != tenant:
+		return errors.Wrapf(models.ErrForbidden, "tenant %q", key.TenantID)
+	}
+	if err = models.ValidateTenant(key.TenantID); err != nil {
+		return errors.Wrapf(err, "tenant %q", key.TenantID)
+	}
+	if key.OwnerID == "" || len(key.OwnerID) > maxOwnerLen || !utf8.ValidString(key.OwnerID) {
+		return errors.Wrapf(models.ErrInvalidOwner, "invalid owner %q", key.OwnerID)
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return errors.Wrap(err, "failed to generate api key")
+	}
+	plain := KeyPrefix + hex.EncodeToString(secret)
+	key.Prefix = plain[:visiblePrefixLen]
+	key.Hash = hashKey(plain)
+
+	if err = a.storage.CreateAPIKey(ctx, key); err != nil {
+		return err
+	}
+	key.Key = plain
+	a.log.Info().Int("key_id", key.ID).Str("tenant_id", key.TenantID).Str("owner_id", key.OwnerID).Bool("admin", key.Admin).Msg("api key created")
+
+	return nil
+}
+
+// Получаем ключи арендатора вызывающего без самих ключей, оператор видит ключи всех арендаторов
+func (a *authService) GetAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	tenant, err := models.TenantScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.storage.GetAPIKeys(ctx, tenant)
+}
+
+// Отзываем ключ, запросы с ним сразу перестают проходить
+// Ключ другого арендатора не найден, если вызывающий не оператор
+func (a *authService) RevokeAPIKey(ctx context.Context, id int) error {
+	tenant, err := models.TenantScope(ctx)
+	if err != nil {
+		return err
+	}
+	if err = a.storage.RevokeAPIKey(ctx, tenant, id); err != nil {
+		return err
+	}
+	a.log.Info().Int("key_id", id).Msg("api key revoked")
+
+	return nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// adminKey - ключ администратора из конфигурации, пустой - вход только по ключам из БД
+// tokens - проверка JWT, nil - JWT не принимаются
+func New(log zerolog.Logger, storage Storage, tokens TokenVerifier, adminKey string, adminTenant string, adminOwner string) AuthService {
+	a := &authService{
+		log:         log,
+		storage:     storage,
+		tokens:      tokens,
+		adminTenant: adminTenant,
+		adminOwner:  adminOwner,
+	}
+	if adminKey != "" {
+		a.adminHash = hashKey(adminKey)
+	}
+
+	return a
+}
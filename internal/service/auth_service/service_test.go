@@ -0,0 +1,106 @@
+package auth_service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const testAdminKey = KeyPrefix + "operator"
+
+// Запоминает арендатора, с которым пришел запрос к ключам
+type fakeStorage struct {
+	Storage
+	created []models.APIKey
+	tenant  string
+}
+
+func (f *fakeStorage) CreateAPIKey(_ context.Context, key *models.APIKey) error {
+	f.created = append(f.created, *key)
+	return nil
+}
+
+func (f *fakeStorage) GetAPIKeyByHash(context.Context, string) (*models.APIKey, error) {
+	return &models.APIKey{TenantID: "acme", OwnerID: "alice", Admin: true}, nil
+}
+
+func (f *fakeStorage) GetAPIKeys(_ context.Context, tenant string) ([]models.APIKey, error) {
+	f.tenant = tenant
+	return nil, nil
+}
+
+func (f *fakeStorage) RevokeAPIKey(_ context.Context, tenant string, _ int) error {
+	f.tenant = tenant
+	return nil
+}
+
+// Ключ администратора арендатора и JWT с правом admin управляют только своим арендатором,
+// ключами всех арендаторов управляет только оператор из AUTH_ADMIN_KEY
+func TestAPIKeysAreScopedByTenant(t *testing.T) {
+	storage := &fakeStorage{}
+	auth := New(zerolog.Nop(), storage, nil, testAdminKey, models.DefaultTenant, "admin")
+
+	operator, err := auth.Authenticate(context.Background(), testAdminKey)
+	if err != nil || !operator.Operator {
+		t.Fatalf("admin key principal = %+v, %v, want operator", operator, err)
+	}
+	tenantAdmin, err := auth.Authenticate(context.Background(), KeyPrefix+"alice")
+	if err != nil || tenantAdmin.Operator || !tenantAdmin.HasScope(models.ScopeAdmin) {
+		t.Fatalf("admin api key principal = %+v, %v, want tenant admin", tenantAdmin, err)
+	}
+	jwtAdmin := &models.Principal{TenantID: "acme", OwnerID: "bob", Scopes: []string{models.ScopeAdmin}}
+
+	tests := []struct {
+		name      string
+		principal *models.Principal
+		tenant    string
+		want      string
+		err       error
+	}{
+		{"api key for own tenant", tenantAdmin, "", "acme", nil},
+		{"api key for other tenant", tenantAdmin, "other", "", models.ErrForbidden},
+		{"jwt for own tenant", jwtAdmin, "acme", "acme", nil},
+		{"jwt for other tenant", jwtAdmin, "other", "", models.ErrForbidden},
+		{"operator for other tenant", operator, "other", "other", nil},
+		{"operator without tenant", operator, "", models.DefaultTenant, nil},
+	}
+	for _, tt := range tests {
+		storage.created = nil
+		ctx := models.WithPrincipal(context.Background(), tt.principal)
+		err := auth.CreateAPIKey(ctx, &models.APIKey{OwnerID: "carol", TenantID: tt.tenant})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: CreateAPIKey error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err != nil {
+			if len(storage.created) != 0 {
+				t.Errorf("%s: key created", tt.name)
+			}
+			continue
+		}
+		if len(storage.created) != 1 || storage.created[0].TenantID != tt.want {
+			t.Errorf("%s: created %+v, want tenant %q", tt.name, storage.created, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		principal *models.Principal
+		want      string
+	}{
+		{tenantAdmin, "acme"},
+		{jwtAdmin, "acme"},
+		{operator, ""},
+	} {
+		ctx := models.WithPrincipal(context.Background(), tt.principal)
+		if _, err = auth.GetAPIKeys(ctx); err != nil || storage.tenant != tt.want {
+			t.Errorf("GetAPIKeys by %s: tenant %q, %v, want %q", tt.principal.OwnerID, storage.tenant, err, tt.want)
+		}
+		storage.tenant = "unset"
+		if err = auth.RevokeAPIKey(ctx, 1); err != nil || storage.tenant != tt.want {
+			t.Errorf("RevokeAPIKey by %s: tenant %q, %v, want %q", tt.principal.OwnerID, storage.tenant, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package dlq_service
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+type Storage interface {
+	// Сохраняем недоставленную задачу
+	SaveDeadLetter(ctx context.Context, deadLetter *models.DeadLetter) error
+	// Получаем недоставленные задачи арендатора, пустой статус или арендатор - все
+	GetDeadLetters(ctx context.Context, tenant string, status string) ([]models.DeadLetter, error)
+	// Получаем недоставленную задачу арендатора по id, пустой арендатор - любого
+	GetDeadLetter(ctx context.Context, tenant string, id int) (*models.DeadLetter, error)
+	// Меняем статус недоставленной задачи, если он совпадает с ожидаемым
+	UpdateDeadLetterStatus(ctx context.Context, id int, from string, to string) error
+	// Обновляем статус задачи на генерацию миниатюры
+	UpdateThumbnailJob(ctx context.Context, jobID int, status string, jobErr string) error
+}
+
+type DeadLetterService interface {
+	// Запускаем сохранение недоставленных задач из Nats в БД
+	Start() error
+	// Останавливаем сохранение
+	Stop()
+	// Получаем недоставленные задачи арендатора вызывающего
+	GetDeadLetters(ctx context.Context, status string) ([]models.DeadLetter, error)
+	// Получаем недоставленную задачу арендатора вызывающего по id
+	GetDeadLetter(ctx context.Context, id int) (*models.DeadLetter, error)
+	// Возвращаем задачу в очередь на обработку
+	Retry(ctx context.Context, id int) error
+	// Отказываемся от задачи
+	Discard(ctx context.Context, id int) error
+}
+
+type dlqService struct {
+	log        zerolog.Logger
+	storage    Storage
+	js         jetstream.JetStream
+	jsConsumer jetstream.Consumer
+	consumeCtx jetstream.ConsumeContext
+}
+
+// Запускаем сохранение недоставленных задач из Nats в БД
+func (d *dlqService) Start() error {
+	consumeCtx, err := d.jsConsumer.Consume(d.handle)
+	if err != nil {
+		return errors.Wrap(err, "failed to consume dead letters")
+	}
+	d.consumeCtx = consumeCtx
+
+	return nil
+}
+
+// Останавливаем сохранение
+func (d *dlqService) Stop() {
+	if d.consumeCtx != nil {
+		d.consumeCtx.Stop()
+	}
+}
+
+// Сохраняем сообщение из media.dlq.> в БД
+func (d *dlqService) handle(msg jetstream.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		d.log.Error().Err(err).Msg("failed to get dead letter metadata")
+		d.nak(msg)
+		return
+	}
+
+	deadLetter := &models.DeadLetter{
+		StreamSeq: meta.Sequence.Stream,
+		Subject:   msg.Headers().Get(models.HeaderDeadLetterSubject),
+		Payload:   string(msg.Data()),
+		Error:     msg.Headers().Get(models.HeaderDeadLetterError),
+	}
+	deadLetter.Attempts, _ = strconv.Atoi(msg.Headers().Get(models.HeaderDeadLetterAttempts))
+	if deadLetter.Subject == "" {
+		deadLetter.Subject = models.PictureSubject(models.DefaultTenant)
+	}
+
+	// Битое сообщение сохраняем без привязки к задаче
+	var info models.InfoForThumbnail
+	if err = json.Unmarshal(msg.Data(), &info); err == nil {
+		deadLetter.JobID = info.JobID
+		deadLetter.UploadID = info.UploadID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err = d.storage.SaveDeadLetter(ctx, deadLetter); err != nil {
+		d.log.Error().Err(err).Msg("failed to save dead letter")
+		d.nak(msg)
+		return
+	}
+
+	if err = msg.Ack(); err != nil {
+		d.log.Error().Err(err).Msg("failed to ack dead letter")
+	}
+}
+
+func (d *dlqService) nak(msg jetstream.Msg) {
+	if err := msg.NakWithDelay(5 * time.Second); err != nil {
+		d.log.Error().Err(err).Msg("failed to nak dead letter")
+	}
+}
+
+// Получаем недоставленные задачи арендатора вызывающего, оператор видит задачи всех арендаторов
+func (d *dlqService) GetDeadLetters(ctx context.Context, status string) ([]models.DeadLetter, error) {
+	tenant, err := models.TenantScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadLetters, err := d.storage.GetDeadLetters(ctx, tenant, status)
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+// Получаем недоставленную задачу арендатора вызывающего по id, задача другого арендатора - ErrNotFound
+func (d *dlqService) GetDeadLetter(ctx context.Context, id int) (*models.DeadLetter, error) {
+	tenant, err := models.TenantScope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadLetter, err := d.storage.GetDeadLetter(ctx, tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	return deadLetter, nil
+}
+
+// Возвращаем задачу в очередь на обработку
+func (d *dlqService) Retry(ctx context.Context, id int) error {
+	deadLetter, err := d.GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if deadLetter.Status != models.DeadLetterStatusDead {
+		return models.ErrConflict
+	}
+
+	// Статус меняем до публикации, чтобы два одновременных запроса не отправили задачу дважды
+	if err = d.storage.UpdateDeadLetterStatus(ctx, id, models.DeadLetterStatusDead, models.DeadLetterStatusRetried); err != nil {
+		return err
+	}
+
+	// Задачу сбрасываем до публикации: после нее воркер может успеть взять задачу в работу,
+	// и поздний сброс вернул бы выполненную задачу в pending
+	if deadLetter.JobID != 0 {
+		if err = d.storage.UpdateThumbnailJob(ctx, deadLetter.JobID, models.JobStatusPending, ""); err != nil {
+			d.restoreDeadLetter(ctx, id)
+			return err
+		}
+	}
+
+	if _, err = d.js.Publish(ctx, deadLetter.Subject, []byte(deadLetter.Payload)); err != nil {
+		d.log.Error().Err(err).Int("dead_letter_id", id).Msg("failed to republish dead letter")
+		if deadLetter.JobID != 0 {
+			if rollbackErr := d.storage.UpdateThumbnailJob(ctx, deadLetter.JobID, models.JobStatusFailed, deadLetter.Error); rollbackErr != nil {
+				d.log.Error().Err(rollbackErr).Int("job_id", deadLetter.JobID).Msg("failed to restore thumbnail job status")
+			}
+		}
+		d.restoreDeadLetter(ctx, id)
+		return errors.Wrap(err, "failed to republish dead letter")
+	}
+
+	return nil
+}
+
+// Возвращаем задаче статус dead после неудачной повторной постановки, ошибку только логируем
+func (d *dlqService) restoreDeadLetter(ctx context.Context, id int) {
+	if err := d.storage.UpdateDeadLetterStatus(ctx, id, models.DeadLetterStatusRetried, models.DeadLetterStatusDead); err != nil {
+		d.log.Error().Err(err).Int("dead_letter_id", id).Msg("failed to restore dead letter status")
+	}
+}
+
+// Отказываемся от задачи
+func (d *dlqService) Discard(ctx context.Context, id int) error {
+	if _, err := d.GetDeadLetter(ctx, id); err != nil {
+		return err
+	}
+
+	return d.storage.UpdateDeadLetterStatus(ctx, id, models.DeadLetterStatusDead, models.DeadLetterStatusDiscarded)
+}
+
+func New(log zerolog.Logger, storage Storage, js jetstream.JetStream, jsConsumer jetstream.Consumer) DeadLetterService {
+	return &dlqService{
+		log:        log,
+		storage:    storage,
+		js:         js,
+		jsConsumer: jsConsumer,
+	}
+}
@@ -0,0 +1,124 @@
+package dlq_service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Хранилище и JetStream пишут свои вызовы в общий журнал, чтобы проверить порядок
+type fakeStorage struct {
+	Storage
+	calls      *[]string
+	deadLetter models.DeadLetter
+}
+
+func (f *fakeStorage) GetDeadLetter(_ context.Context, tenant string, _ int) (*models.DeadLetter, error) {
+	if tenant != "" && f.deadLetter.Subject != models.PictureSubject(tenant) {
+		return nil, models.ErrNotFound
+	}
+	deadLetter := f.deadLetter
+	return &deadLetter, nil
+}
+
+func (f *fakeStorage) UpdateDeadLetterStatus(_ context.Context, _ int, from string, to string) error {
+	*f.calls = append(*f.calls, fmt.Sprintf("dead letter %s->%s", from, to))
+	return nil
+}
+
+func (f *fakeStorage) UpdateThumbnailJob(_ context.Context, jobID int, status string, jobErr string) error {
+	*f.calls = append(*f.calls, fmt.Sprintf("job %d %s %q", jobID, status, jobErr))
+	return nil
+}
+
+type fakeJetStream struct {
+	jetstream.JetStream
+	calls *[]string
+	err   error
+}
+
+func (f *fakeJetStream) Publish(_ context.Context, subject string, _ []byte, _ ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	*f.calls = append(*f.calls, "publish "+subject)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &jetstream.PubAck{}, nil
+}
+
+func newTestService(publishErr error) (DeadLetterService, *[]string) {
+	calls := new([]string)
+	storage := &fakeStorage{calls: calls, deadLetter: models.DeadLetter{
+		ID: 1, JobID: 7, Subject: "media.acme.picture", Payload: "{}", Error: "boom", Status: models.DeadLetterStatusDead,
+	}}
+	return New(zerolog.Nop(), storage, &fakeJetStream{calls: calls, err: publishErr}, nil), calls
+}
+
+// Контекст запроса администратора арендатора
+func asTenant(tenant string) context.Context {
+	return models.WithPrincipal(context.Background(), &models.Principal{TenantID: tenant, OwnerID: "admin", Scopes: []string{models.ScopeAdmin}})
+}
+
+func TestRetryResetsJobBeforePublish(t *testing.T) {
+	svc, calls := newTestService(nil)
+	if err := svc.Retry(asTenant("acme"), 1); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+
+	want := []string{
+		"dead letter dead->retried",
+		`job 7 pending ""`,
+		"publish media.acme.picture",
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("calls = %q, want %q", *calls, want)
+	}
+}
+
+func TestRetryRollsBackWhenPublishFails(t *testing.T) {
+	svc, calls := newTestService(errors.New("nats is down"))
+	if err := svc.Retry(asTenant("acme"), 1); err == nil {
+		t.Fatal("Retry succeeded, want publish error")
+	}
+
+	want := []string{
+		"dead letter dead->retried",
+		`job 7 pending ""`,
+		"publish media.acme.picture",
+		`job 7 failed "boom"`,
+		"dead letter retried->dead",
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("calls = %q, want %q", *calls, want)
+	}
+}
+
+// Администратор арендатора не видит чужие задачи, оператор управляет задачами всех арендаторов
+func TestDeadLettersAreScopedByTenant(t *testing.T) {
+	svc, calls := newTestService(nil)
+	if _, err := svc.GetDeadLetter(asTenant("other"), 1); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetDeadLetter from other tenant error = %v, want ErrNotFound", err)
+	}
+	if err := svc.Retry(asTenant("other"), 1); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("Retry from other tenant error = %v, want ErrNotFound", err)
+	}
+	if err := svc.Discard(asTenant("other"), 1); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("Discard from other tenant error = %v, want ErrNotFound", err)
+	}
+	if len(*calls) != 0 {
+		t.Fatalf("calls = %q, want none", *calls)
+	}
+
+	operator := models.WithPrincipal(context.Background(), &models.Principal{TenantID: "default", OwnerID: "admin", Operator: true})
+	if err := svc.Retry(operator, 1); err != nil {
+		t.Fatalf("Retry by operator: %v", err)
+	}
+	if _, err := svc.GetDeadLetter(context.Background(), 1); !errors.Is(err, models.ErrUnauthorized) {
+		t.Fatalf("GetDeadLetter without caller error = %v, want ErrUnauthorized", err)
+	}
+}
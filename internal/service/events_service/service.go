@@ -0,0 +1,140 @@
+package events_service
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Сколько событий может ждать медленный подписчик, дальше события для него отбрасываются
+const subscriberBuffer = 16
+
+type EventService interface {
+	// Подписываемся на media.events.> в Nats
+	Start() error
+	// Отписываемся от Nats и закрываем каналы всех подписчиков
+	Stop()
+	// Подписываемся на события загрузки, канал закрывается при остановке сервиса
+	// Возвращаемая функция отменяет подписку
+	Subscribe(uploadID int) (<-chan models.ThumbnailEvent, func())
+}
+
+type eventService struct {
+	log zerolog.Logger
+	nc  *nats.Conn
+	sub *nats.Subscription
+
+	mu          sync.Mutex
+	subscribers map[int]map[chan models.ThumbnailEvent]struct{}
+	stopped     bool
+}
+
+// Подписываемся на media.events.> в Nats
+func (e *eventService) Start() error {
+	sub, err := e.nc.Subscribe(models.SubjectEventPrefix+">", e.handle)
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to events")
+	}
+	e.sub = sub
+
+	return nil
+}
+
+// Отписываемся от Nats и закрываем каналы всех подписчиков
+func (e *eventService) Stop() {
+	if e.sub != nil {
+		if err := e.sub.Unsubscribe(); err != nil {
+			e.log.Error().Err(err).Msg("failed to unsubscribe from events")
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stopped = true
+	for _, channels := range e.subscribers {
+		for ch := range channels {
+			close(ch)
+		}
+	}
+	e.subscribers = make(map[int]map[chan models.ThumbnailEvent]struct{})
+}
+
+// Подписываемся на события загрузки, канал закрывается при остановке сервиса
+func (e *eventService) Subscribe(uploadID int) (<-chan models.ThumbnailEvent, func()) {
+	ch := make(chan models.ThumbnailEvent, subscriberBuffer)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	if e.subscribers[uploadID] == nil {
+		e.subscribers[uploadID] = make(map[chan models.ThumbnailEvent]struct{})
+	}
+	e.subscribers[uploadID][ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() { e.unsubscribe(uploadID, ch) })
+	}
+}
+
+func (e *eventService) unsubscribe(uploadID int, ch chan models.ThumbnailEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	channels, ok := e.subscribers[uploadID]
+	if !ok {
+		return
+	}
+	if _, ok = channels[ch]; !ok {
+		// Канал уже закрыт в Stop
+		return
+	}
+	delete(channels, ch)
+	close(ch)
+	if len(channels) == 0 {
+		delete(e.subscribers, uploadID)
+	}
+}
+
+// Раздаем событие подписчикам загрузки
+func (e *eventService) handle(msg *nats.Msg) {
+	uploadID, err := strconv.Atoi(strings.TrimPrefix(msg.Subject, models.SubjectEventPrefix))
+	if err != nil {
+		e.log.Error().Str("subject", msg.Subject).Msg("unexpected event subject")
+		return
+	}
+
+	var event models.ThumbnailEvent
+	if err = json.Unmarshal(msg.Data, &event); err != nil {
+		e.log.Error().Err(err).Msg("failed to decode event")
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subscribers[uploadID] {
+		// Не ждем медленного клиента, чтобы не задерживать остальных
+		select {
+		case ch <- event:
+		default:
+			e.log.Warn().Int("upload_id", uploadID).Msg("event subscriber is too slow, event dropped")
+		}
+	}
+}
+
+func New(log zerolog.Logger, nc *nats.Conn) EventService {
+	return &eventService{
+		log:         log,
+		nc:          nc,
+		subscribers: make(map[int]map[chan models.ThumbnailEvent]struct{}),
+	}
+}
@@ -2,83 +2,273 @@ package main_service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"time"
 
+	"github.com/Yury132/Golang-Task-2/internal/imaging"
 	"github.com/Yury132/Golang-Task-2/internal/models"
-	"github.com/nats-io/nats.go/jetstream"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
 type Storage interface {
-	// Загрузка данных в БД об изначальных изображениях
-	SaveFileMeta(ctx context.Context, metaInfo *models.ImageMeta) error
-	// Загрузка данных в БД о миниатюрах
-	SaveFileMiniMeta(ctx context.Context, metaInfo *models.ImageMeta) error
+	// Загрузка данных в БД об изначальном изображении вместе с задачами и сообщениями для Nats
+	// Если загрузка с тем же содержимым уже есть и force не задан, возвращается она, без задач
+	// Новая загрузка сверх quota арендатора не сохраняется, ErrQuotaExceeded
+	SaveUpload(ctx context.Context, owner models.Owner, metaInfo *models.ImageMeta, force bool, quota models.Quota, presets []models.ThumbnailPreset, newMessage models.OutboxBuilder) (*models.SavedUpload, error)
+	// Получаем занятое арендатором место
+	GetTenantUsage(ctx context.Context, tenant string) (*models.TenantUsage, error)
 	// Получаем информацию о картинках
-	GetData(ctx context.Context) ([]models.AllImages, error)
+	GetData(ctx context.Context, owner models.Owner) ([]models.AllImages, error)
 	// Получаем информацию о картинках по id
-	GetDataId(ctx context.Context, id int) ([]models.AllImages, error)
+	GetDataId(ctx context.Context, owner models.Owner, id int) (*models.UploadInfo, error)
+	// Получаем страницу списка загрузок с миниатюрами
+	ListUploads(ctx context.Context, owner models.Owner, filter models.UploadFilter) (*models.UploadPage, error)
+	// Получаем состояние задачи на миниатюру
+	GetThumbnailJob(ctx context.Context, owner models.Owner, id int) (*models.ThumbnailJob, error)
+	// Ищем изображения, хэш которых отличается не больше чем на maxDistance бит
+	GetSimilar(ctx context.Context, owner models.Owner, id int, maxDistance int) ([]models.SimilarImage, error)
+	// Помечаем загрузку удаленной и отменяем ее невыполненные задачи
+	DeleteUpload(ctx context.Context, owner models.Owner, id int) error
+	// Восстанавливаем загрузку, удаленную не раньше чем window назад, и повторно ставим отмененные задачи
+	RestoreUpload(ctx context.Context, owner models.Owner, id int, window time.Duration, msgID func(jobID int) string) (int, error)
 }
 
 type ObjectStorage interface {
-	// Сохранение изображения в хранилище
-	Save(data []byte, name string) error
+	// Сохранение изображения в хранилище, данные читаются потоком
+	Save(ctx context.Context, r io.Reader, name string) error
+	// Открываем изображение для чтения
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, *models.ObjectInfo, error)
+	// Удаляем изображение из хранилища
+	Delete(ctx context.Context, name string) error
+}
+
+// Отправка сообщений из outbox в Nats
+type OutboxRelay interface {
+	// Будим отправку, не дожидаясь очередного опроса
+	Notify()
+}
+
+// Проверка поддержки формата миниатюр
+type ImageFormats interface {
+	// Поддерживается ли кодирование в формат
+	Supports(format string) bool
 }
 
 type Service interface {
-	// Загружаем изображение
-	UploadPhoto(ctx context.Context, data []byte, metaInfo *models.ImageMeta, thumbSize int) error
+	// Загружаем изображение, повторная загрузка того же содержимого возвращает существующую запись
+	// force сохраняет новую копию даже при совпадении содержимого
+	UploadPhoto(ctx context.Context, r io.Reader, metaInfo *models.ImageMeta, opts models.ThumbnailOptions, force bool) (*models.UploadResult, error)
 	// Получаем информацию о картинках
 	GetData(ctx context.Context) ([]models.AllImages, error)
 	// Получаем информацию о картинках по id
-	GetDataId(ctx context.Context, id int) ([]models.AllImages, error)
+	GetDataId(ctx context.Context, id int) (*models.UploadInfo, error)
+	// Получаем страницу списка загрузок с миниатюрами
+	ListUploads(ctx context.Context, filter models.UploadFilter) (*models.UploadPage, error)
+	// Получаем состояние задачи на миниатюру
+	GetJob(ctx context.Context, id int) (*models.ThumbnailJob, error)
+	// Открываем оригинал изображения
+	GetOriginal(ctx context.Context, id int) (*models.ImageFile, error)
+	// Открываем миниатюру изображения по имени пресета
+	GetThumbnail(ctx context.Context, id int, preset string) (*models.ImageFile, error)
+	// Ищем похожие изображения, maxDistance < 0 - расстояние из конфигурации
+	GetSimilar(ctx context.Context, id int, maxDistance int) ([]models.SimilarImage, error)
+	// Удаляем загрузку, до окончательного удаления ее можно восстановить
+	DeleteUpload(ctx context.Context, id int) error
+	// Восстанавливаем удаленную загрузку
+	RestoreUpload(ctx context.Context, id int) error
+	// Получаем занятое арендатором место и его лимиты
+	GetUsage(ctx context.Context) (*models.TenantUsage, error)
 }
 
 type service struct {
 	log           zerolog.Logger
 	storage       Storage
 	objectStorage ObjectStorage
-	js            jetstream.JetStream
+	outbox        OutboxRelay
+	presets       []models.ThumbnailPreset
+	formats       ImageFormats
+	// Расстояние Хэмминга по умолчанию для поиска похожих
+	maxDistance int
+	// Сколько удаленная загрузка может быть восстановлена
+	purgeWindow time.Duration
+	// Лимиты арендаторов
+	quotas models.QuotaPolicy
 }
 
-// Загружаем изображение
-func (s *service) UploadPhoto(ctx context.Context, data []byte, metaInfo *models.ImageMeta, thumbSize int) error {
-	// Сохраняем на диск
-	if err := s.objectStorage.Save(data, metaInfo.Name); err != nil {
+// Имя пресета для размера, переданного в запросе
+const customPreset = "custom"
+
+// Загружаем изображение от имени владельца из контекста
+// На каждый пресет создается отдельная задача, opts.Size > 0 добавляет пресет "custom"
+// Загрузка сверх лимитов арендатора отклоняется с ErrQuotaExceeded
+func (s *service) UploadPhoto(ctx context.Context, r io.Reader, metaInfo *models.ImageMeta, opts models.ThumbnailOptions, force bool) (*models.UploadResult, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Исчерпанный лимит проверяем до чтения тела, окончательно его проверит SaveUpload
+	quota := s.quotas.For(owner.TenantID)
+	sized := &sizeReader{r: r, max: -1}
+	if quota.MaxBytes > 0 || quota.MaxImages > 0 {
+		usage, err := s.storage.GetTenantUsage(ctx, owner.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		if quota.Exceeded(*usage, 1, 0) {
+			return nil, models.ErrQuotaExceeded
+		}
+		if quota.MaxBytes > 0 {
+			sized.max = quota.MaxBytes - usage.Bytes
+		}
+	}
+
+	// Пресеты из конфигурации плюс параметры из запроса
+	presets, err := s.buildPresets(opts)
+	if err != nil {
+		s.log.Error().Err(err).Msg("invalid thumbnail options")
+		return nil, err
+	}
+
+	// Имя от клиента храним только как метаданные, ключ в хранилище генерируем сами,
+	// чтобы одинаковые имена не перезаписывали друг друга и не выходили за пределы хранилища
+	if err = models.ValidateFileName(metaInfo.OriginalName); err != nil {
+		s.log.Error().Err(err).Str("name", metaInfo.OriginalName).Msg("invalid file name")
+		return nil, err
+	}
+	metaInfo.Name = models.TenantObjectName(owner.TenantID, uuid.New().String()+imaging.Extension(metaInfo.Type))
+
+	// Сохраняем в хранилище прямо из тела запроса, попутно считая хэш и размер содержимого
+	hash := sha256.New()
+	if err = s.objectStorage.Save(ctx, io.TeeReader(sized, hash), metaInfo.Name); err != nil {
+		// Хранилище может не сохранить ошибку чтения в цепочке, поэтому смотрим на счетчик
+		if sized.exceeded() {
+			return nil, models.ErrQuotaExceeded
+		}
 		s.log.Error().Err(err).Msg("save to object storage err")
-		return err
+		return nil, err
 	}
-	// Сохраняем в БД
-	if err := s.storage.SaveFileMeta(ctx, metaInfo); err != nil {
+	metaInfo.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	metaInfo.Size = sized.n
+
+	// Сохраняем в БД вместе с задачами, в Nats их отправит outbox
+	saved, err := s.storage.SaveUpload(ctx, owner, metaInfo, force, quota, presets, func(uploadID int, jobID int, preset models.ThumbnailPreset) (*models.OutboxMessage, error) {
+		return newThumbnailMessage(owner.TenantID, metaInfo.Name, uploadID, jobID, preset)
+	})
+	if err != nil {
 		s.log.Error().Err(err).Msg("save to db err")
-		return err
+		s.deleteObject(metaInfo.Name)
+		return nil, err
+	}
+	if saved.Created {
+		s.outbox.Notify()
+	} else {
+		// Такое содержимое уже загружено, копия не нужна
+		s.deleteObject(metaInfo.Name)
+	}
+
+	upload, err := s.storage.GetDataId(ctx, owner, saved.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := saved.Jobs
+	if jobs == nil {
+		jobs = make([]models.UploadJob, 0)
 	}
 
-	// Готовим сообщение для отправки
+	return &models.UploadResult{UploadID: saved.ID, Duplicate: !saved.Created, Jobs: jobs, Upload: upload}, nil
+}
+
+// Считаем прочитанные байты, больше max (если max >= 0) прочитать нельзя
+type sizeReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (r *sizeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.exceeded() {
+		return n, models.ErrQuotaExceeded
+	}
+	return n, err
+}
+
+func (r *sizeReader) exceeded() bool {
+	return r.max >= 0 && r.n > r.max
+}
+
+// Удаляем файл, который не попал в БД, ошибку только логируем
+func (s *service) deleteObject(name string) {
+	if err := s.objectStorage.Delete(context.Background(), name); err != nil {
+		s.log.Error().Err(err).Str("name", name).Msg("failed to delete object")
+	}
+}
+
+// Собираем пресеты для загрузки с учетом параметров запроса
+func (s *service) buildPresets(opts models.ThumbnailOptions) ([]models.ThumbnailPreset, error) {
+	presets := make([]models.ThumbnailPreset, 0, len(s.presets)+1)
+	presets = append(presets, s.presets...)
+	if opts.Size > 0 {
+		// Размер из запроса по умолчанию сохраняется в PNG, как и раньше
+		presets = append(presets, models.ThumbnailPreset{Name: customPreset, Size: opts.Size, Format: imaging.FormatPNG})
+	}
+
+	for i := range presets {
+		if opts.Format != "" {
+			presets[i].Format = opts.Format
+		}
+		if opts.Quality > 0 {
+			presets[i].Quality = opts.Quality
+		}
+		if !s.formats.Supports(presets[i].Format) {
+			return nil, fmt.Errorf("%w: thumbnail format %q is not supported", models.ErrInvalidUpload, presets[i].Format)
+		}
+	}
+
+	return presets, nil
+}
+
+// Готовим сообщение в Nats для задачи на генерацию миниатюры
+func newThumbnailMessage(tenant string, name string, uploadID int, jobID int, preset models.ThumbnailPreset) (*models.OutboxMessage, error) {
 	msg := models.InfoForThumbnail{
-		Path: fmt.Sprintf("uploads/%s", metaInfo.Name),
-		Size: thumbSize,
+		Tenant:   tenant,
+		Name:     name,
+		Size:     preset.Size,
+		Preset:   preset.Name,
+		Format:   preset.Format,
+		Quality:  preset.Quality,
+		UploadID: uploadID,
+		JobID:    jobID,
 	}
 	// Кодируем
 	b, err := json.Marshal(msg)
 	if err != nil {
-		s.log.Error().Err(err).Msg("js message marshal err")
-		return err
-	}
-
-	// Отправляем сообщение в Nats
-	if _, err = s.js.Publish(ctx, "media.picture", b); err != nil {
-		s.log.Error().Err(err).Msg("failed to publish message")
-		return err
+		return nil, errors.Wrap(err, "js message marshal err")
 	}
 
-	return nil
+	return &models.OutboxMessage{
+		Subject: models.PictureSubject(tenant),
+		MsgID:   fmt.Sprintf("thumbnail-job-%d", jobID),
+		Payload: b,
+	}, nil
 }
 
 // Получаем информацию о картинках
 func (s *service) GetData(ctx context.Context) ([]models.AllImages, error) {
-	images, err := s.storage.GetData(ctx)
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.storage.GetData(ctx, owner)
 	if err != nil {
 		return nil, err
 	}
@@ -86,19 +276,154 @@ func (s *service) GetData(ctx context.Context) ([]models.AllImages, error) {
 }
 
 // Получаем информацию о картинках по id
-func (s *service) GetDataId(ctx context.Context, id int) ([]models.AllImages, error) {
-	images, err := s.storage.GetDataId(ctx, id)
+func (s *service) GetDataId(ctx context.Context, id int) (*models.UploadInfo, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.storage.GetDataId(ctx, owner, id)
 	if err != nil {
 		return nil, err
 	}
 	return images, nil
 }
 
-func New(log zerolog.Logger, storage Storage, objectStorage ObjectStorage, js jetstream.JetStream) Service {
+// Получаем страницу списка загрузок с миниатюрами
+func (s *service) ListUploads(ctx context.Context, filter models.UploadFilter) (*models.UploadPage, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.storage.ListUploads(ctx, owner, filter)
+}
+
+// Получаем состояние задачи на миниатюру
+func (s *service) GetJob(ctx context.Context, id int) (*models.ThumbnailJob, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.storage.GetThumbnailJob(ctx, owner, id)
+}
+
+// Открываем оригинал изображения
+func (s *service) GetOriginal(ctx context.Context, id int) (*models.ImageFile, error) {
+	upload, err := s.GetDataId(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ключ оригинала уникален, содержимое не меняется
+	return s.openImage(ctx, upload.Name, upload.Type, true)
+}
+
+// Открываем миниатюру изображения по имени пресета
+func (s *service) GetThumbnail(ctx context.Context, id int, preset string) (*models.ImageFile, error) {
+	upload, err := s.GetDataId(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, thumbnail := range upload.Thumbnails {
+		if thumbnail.Preset == preset {
+			// У миниатюр уникальные имена, содержимое не меняется
+			return s.openImage(ctx, thumbnail.Name, thumbnail.Type, true)
+		}
+	}
+
+	return nil, models.ErrNotFound
+}
+
+// Ищем похожие изображения, maxDistance < 0 - расстояние из конфигурации
+func (s *service) GetSimilar(ctx context.Context, id int, maxDistance int) ([]models.SimilarImage, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if maxDistance < 0 {
+		maxDistance = s.maxDistance
+	}
+
+	return s.storage.GetSimilar(ctx, owner, id, maxDistance)
+}
+
+// Удаляем загрузку, до окончательного удаления ее можно восстановить
+// Файлы удалит фоновая очистка после окна восстановления
+func (s *service) DeleteUpload(ctx context.Context, id int) error {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.DeleteUpload(ctx, owner, id)
+}
+
+// Восстанавливаем удаленную загрузку
+// Отмененные при удалении задачи ставятся снова, под новым Nats-Msg-Id, чтобы их не отбросила защита от дублей
+func (s *service) RestoreUpload(ctx context.Context, id int) error {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	requeued, err := s.storage.RestoreUpload(ctx, owner, id, s.purgeWindow, func(jobID int) string {
+		return fmt.Sprintf("thumbnail-job-%d-restored-%d", jobID, time.Now().UnixNano())
+	})
+	if err != nil {
+		return err
+	}
+	if requeued > 0 {
+		s.outbox.Notify()
+	}
+
+	return nil
+}
+
+// Получаем занятое арендатором место и его лимиты
+func (s *service) GetUsage(ctx context.Context) (*models.TenantUsage, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := s.storage.GetTenantUsage(ctx, owner.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	usage.Quota = s.quotas.For(owner.TenantID)
+
+	return usage, nil
+}
+
+// Открываем изображение в хранилище
+func (s *service) openImage(ctx context.Context, name string, imageType string, immutable bool) (*models.ImageFile, error) {
+	content, info, err := s.objectStorage.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ImageFile{
+		Name:        name,
+		ContentType: "image/" + imageType,
+		Size:        info.Size,
+		ModTime:     info.ModTime,
+		Immutable:   immutable,
+		Content:     content,
+	}, nil
+}
+
+func New(log zerolog.Logger, storage Storage, objectStorage ObjectStorage, outbox OutboxRelay, presets []models.ThumbnailPreset, formats ImageFormats, maxDistance int, purgeWindow time.Duration, quotas models.QuotaPolicy) Service {
 	return &service{
 		log:           log,
 		storage:       storage,
 		objectStorage: objectStorage,
-		js:            js,
+		outbox:        outbox,
+		presets:       presets,
+		formats:       formats,
+		maxDistance:   maxDistance,
+		purgeWindow:   purgeWindow,
+		quotas:        quotas,
 	}
 }
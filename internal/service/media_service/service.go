@@ -5,34 +5,92 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"image"
-	"image/png"
-	"os"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/Yury132/Golang-Task-2/internal/imaging"
 	"github.com/Yury132/Golang-Task-2/internal/models"
 	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
-	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
 type MediaService interface {
 	// Создание миниатюры
 	CreateThumbnail(info *models.InfoForThumbnail) error
-	// Получаем сообщение из Nats
-	GetTaskForProcessing() (*models.InfoForThumbnail, error)
+	// Получаем из Nats не больше max задач и передаем их в handler по мере поступления, ждем не дольше wait
+	FetchTasks(max int, wait time.Duration, handler func(task *models.Task)) error
+	// Перекладываем в очередь недоставленных задачи, доставки которых исчерпаны без ответа обработчика,
+	// возвращаем функцию остановки
+	WatchMaxDeliveries() (func(), error)
+	// Подтверждаем сообщение или возвращаем его в очередь по результату обработки
+	FinishTask(task *models.Task, taskErr error) error
+	// Продлеваем срок подтверждения сообщения, пока задача ждет воркера или выполняется
+	ProgressTask(task *models.Task) error
+	// Возвращаем необработанное сообщение в очередь без задержки
+	ReleaseTask(task *models.Task) error
+}
+
+// Ошибка, при которой повторная обработка не поможет
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Помечаем ошибку как неисправимую
+func permanent(err error) error {
+	return &permanentError{err: err}
 }
 
 type Storage interface {
-	// Загрузка данных в БД об изначальных изображениях
-	SaveFileMeta(ctx context.Context, metaInfo *models.ImageMeta) error
 	// Загрузка данных в БД о миниатюрах
-	SaveFileMiniMeta(ctx context.Context, metaInfo *models.ImageMeta) error
+	SaveFileMiniMeta(ctx context.Context, uploadID int, preset string, metaInfo *models.ImageMeta) error
+	// Обновляем статус задачи на генерацию миниатюры
+	UpdateThumbnailJob(ctx context.Context, jobID int, status string, jobErr string) error
+	// Берем задачу в работу, false - задача отменена, удалена или уже выполнена
+	StartThumbnailJob(ctx context.Context, jobID int) (bool, error)
+	// Посчитан ли уже перцептивный хэш оригинала
+	HasPerceptualHash(ctx context.Context, uploadID int) (bool, error)
+	// Сохраняем перцептивный хэш оригинала
+	SavePerceptualHash(ctx context.Context, uploadID int, hash uint64) error
+	// Ставим событие в журнал доставки вебхуков
+	EnqueueWebhookEvent(ctx context.Context, event *models.WebhookEvent) error
 }
 
 type ObjectStorage interface {
-	// Сохранение изображения в хранилище
-	Save(data []byte, name string) error
+	// Сохранение изображения в хранилище, данные читаются потоком
+	Save(ctx context.Context, r io.Reader, name string) error
+	// Открываем изображение для чтения
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, *models.ObjectInfo, error)
+}
+
+// Публикация событий через обычный Nats
+type EventPublisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// Подписка на служебные сообщения JetStream через обычный Nats
+type Subscriber interface {
+	QueueSubscribe(subject string, queue string, handler nats.MsgHandler) (*nats.Subscription, error)
+}
+
+// Сообщение JetStream о том, что доставки задачи исчерпаны
+type maxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries int    `json:"deliveries"`
 }
 
 type mediaService struct {
@@ -40,123 +98,410 @@ type mediaService struct {
 	storage       Storage
 	objectStorage ObjectStorage
 	jsConsumer    jetstream.Consumer
+	js            jetstream.JetStream
+	events        EventPublisher
+	advisories    Subscriber
+	processor     imaging.ImageProcessor
+	// Задержки перед повторной доставкой, по одной на попытку
+	backOff []time.Duration
+	// Максимальное число доставок сообщения
+	maxDeliver int
 }
 
-// Получаем сообщение из Nats
-func (m *mediaService) GetTaskForProcessing() (*models.InfoForThumbnail, error) {
-	// Получаем сообщение из Nats
-	// Next - блокируется пока нет входящих сообщений или не прошло время таймаута
-	msg, err := m.jsConsumer.Next()
+// Получаем из Nats не больше max задач и передаем их в handler по мере поступления
+// Сообщение подтверждается только после обработки, в FinishTask
+func (m *mediaService) FetchTasks(max int, wait time.Duration, handler func(task *models.Task)) error {
+	batch, err := m.jsConsumer.Fetch(max, jetstream.FetchMaxWait(wait))
 	if err != nil {
-		return nil, err
+		return errors.Wrap(err, "failed to fetch tasks")
 	}
 
-	// Подтверждение сообщения
-	if err = msg.Ack(); err != nil {
-		return nil, err
+	for msg := range batch.Messages() {
+		task, err := m.decodeTask(msg)
+		if err != nil {
+			m.log.Error().Err(err).Send()
+			continue
+		}
+		handler(task)
 	}
+	if err = batch.Error(); err != nil {
+		return errors.Wrap(err, "failed to fetch tasks")
+	}
+
+	return nil
+}
 
-	// Получаем данные из сообщения
-	if msg.Data() == nil {
-		return nil, nil
+// Следим за уведомлениями JetStream об исчерпанных доставках, возвращаем функцию остановки
+// Обработчик сам отправляет задачу в очередь недоставленных на последней попытке,
+// но если он упал, завис или не уложился в AckWait, JetStream просто перестает доставлять сообщение
+func (m *mediaService) WatchMaxDeliveries() (func(), error) {
+	info := m.jsConsumer.CachedInfo()
+	subject := fmt.Sprintf("$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.%s.%s", info.Stream, info.Name)
+	// Группа, чтобы из нескольких экземпляров сервиса уведомление обработал один
+	sub, err := m.advisories.QueueSubscribe(subject, info.Name, m.handleMaxDeliveries)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to subscribe to max deliveries advisories")
 	}
 
-	// Декодируем
+	return func() {
+		if err := sub.Unsubscribe(); err != nil {
+			m.log.Error().Err(err).Msg("failed to unsubscribe from max deliveries advisories")
+		}
+	}, nil
+}
+
+// Перекладываем задачу с исчерпанными доставками в очередь недоставленных и отмечаем ее неудачной
+// В WorkQueue сообщение без подтверждения осталось бы в потоке навсегда, поэтому удаляем его
+func (m *mediaService) handleMaxDeliveries(msg *nats.Msg) {
+	var advisory maxDeliveriesAdvisory
+	if err := json.Unmarshal(msg.Data, &advisory); err != nil {
+		m.log.Error().Err(err).Msg("failed to decode max deliveries advisory")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := m.js.Stream(ctx, advisory.Stream)
+	if err != nil {
+		m.log.Error().Err(err).Str("stream", advisory.Stream).Msg("failed to get stream")
+		return
+	}
+	raw, err := stream.GetMsg(ctx, advisory.StreamSeq)
+	if err != nil {
+		// Сообщение уже удалено, например обработчик ответил в последний момент
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return
+		}
+		m.log.Error().Err(err).Uint64("stream_seq", advisory.StreamSeq).Msg("failed to get undelivered task")
+		return
+	}
+
+	taskErr := fmt.Errorf("no result after %d deliveries", advisory.Deliveries)
+	if err = m.publishDeadLetter(ctx, raw.Subject, raw.Data, advisory.Deliveries, taskErr); err != nil {
+		m.log.Error().Err(err).Uint64("stream_seq", advisory.StreamSeq).Msg("failed to publish dead letter")
+		return
+	}
+	// Битое сообщение отметить нельзя, в очередь недоставленных оно уже попало
+	var info models.InfoForThumbnail
+	if err = json.Unmarshal(raw.Data, &info); err == nil {
+		m.updateJob(&info, models.JobStatusFailed, taskErr.Error(), nil)
+	}
+	if err = stream.DeleteMsg(ctx, advisory.StreamSeq); err != nil && !errors.Is(err, jetstream.ErrMsgNotFound) {
+		m.log.Error().Err(err).Uint64("stream_seq", advisory.StreamSeq).Msg("failed to delete undelivered task")
+	}
+}
+
+// Декодируем задачу из сообщения
+func (m *mediaService) decodeTask(msg jetstream.Msg) (*models.Task, error) {
 	var info = new(models.InfoForThumbnail)
-	if err = json.Unmarshal(msg.Data(), info); err != nil {
-		return nil, err
+	if err := json.Unmarshal(msg.Data(), info); err != nil {
+		// Битое сообщение повторять бессмысленно
+		attempt := 1
+		if meta, metaErr := msg.Metadata(); metaErr == nil {
+			attempt = int(meta.NumDelivered)
+		}
+		if dlqErr := m.publishDeadLetter(context.Background(), msg.Subject(), msg.Data(), attempt, err); dlqErr != nil {
+			m.log.Error().Err(dlqErr).Msg("failed to publish dead letter")
+			return nil, errors.Wrap(err, "failed to decode task")
+		}
+		if termErr := msg.Term(); termErr != nil {
+			m.log.Error().Err(termErr).Msg("failed to term message")
+		}
+		return nil, errors.Wrap(err, "failed to decode task, moved to dead letter queue")
+	}
+
+	return &models.Task{Info: info, Msg: msg}, nil
+}
+
+// Подтверждаем сообщение или возвращаем его в очередь по результату обработки
+// Успех - Ack, неисправимая ошибка или последняя попытка - Term, иначе Nak с задержкой
+func (m *mediaService) FinishTask(task *models.Task, taskErr error) error {
+	if taskErr == nil {
+		return task.Msg.Ack()
+	}
+
+	attempt := 1
+	if meta, err := task.Msg.Metadata(); err == nil {
+		attempt = int(meta.NumDelivered)
 	}
 
-	return info, nil
+	var permErr *permanentError
+	if errors.As(taskErr, &permErr) || (m.maxDeliver > 0 && attempt >= m.maxDeliver) {
+		m.updateJob(task.Info, models.JobStatusFailed, taskErr.Error(), nil)
+		// Сначала перекладываем в очередь недоставленных, иначе задача потеряется
+		if err := m.publishDeadLetter(context.Background(), task.Msg.Subject(), task.Msg.Data(), attempt, taskErr); err != nil {
+			m.log.Error().Err(err).Int("job_id", task.Info.JobID).Msg("failed to publish dead letter")
+			return task.Msg.NakWithDelay(m.retryDelay(attempt))
+		}
+		return task.Msg.Term()
+	}
+
+	// Задача вернется в очередь, сохраняем последнюю ошибку
+	m.updateJob(task.Info, models.JobStatusPending, taskErr.Error(), nil)
+	return task.Msg.NakWithDelay(m.retryDelay(attempt))
+}
+
+// Продлеваем срок подтверждения сообщения, иначе долгая задача будет доставлена повторно
+func (m *mediaService) ProgressTask(task *models.Task) error {
+	return task.Msg.InProgress()
 }
 
-// Через resize
-// Создание миниатюры
-// Тут же сохраняем данные в БД
+// Возвращаем необработанное сообщение в очередь без задержки
+// Используется при остановке, попытка обработки не считается неудачной
+func (m *mediaService) ReleaseTask(task *models.Task) error {
+	return task.Msg.Nak()
+}
+
+// Перекладываем сообщение с темой subject в media.dlq.> вместе с текстом ошибки
+func (m *mediaService) publishDeadLetter(ctx context.Context, subject string, data []byte, attempt int, taskErr error) error {
+	dlqMsg := nats.NewMsg(models.DeadLetterSubject(subject))
+	dlqMsg.Data = data
+	dlqMsg.Header.Set(models.HeaderDeadLetterError, taskErr.Error())
+	dlqMsg.Header.Set(models.HeaderDeadLetterAttempts, strconv.Itoa(attempt))
+	// Повторная постановка отправит задачу без арендатора уже в тему DefaultTenant
+	dlqMsg.Header.Set(models.HeaderDeadLetterSubject, models.TenantPictureSubject(subject))
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if _, err := m.js.PublishMsg(ctx, dlqMsg); err != nil {
+		return errors.Wrap(err, "failed to publish to dead letter queue")
+	}
+
+	return nil
+}
+
+// Задержка перед повторной доставкой для номера попытки
+func (m *mediaService) retryDelay(attempt int) time.Duration {
+	if len(m.backOff) == 0 {
+		return 0
+	}
+	if attempt > len(m.backOff) {
+		attempt = len(m.backOff)
+	}
+
+	return m.backOff[attempt-1]
+}
+
+// Создание миниатюры с отметкой о статусе задачи
 func (m *mediaService) CreateThumbnail(info *models.InfoForThumbnail) error {
+	// Сообщения, отправленные до появления задач, идентификатора не содержат
+	if info.JobID != 0 {
+		started, err := m.storage.StartThumbnailJob(context.Background(), info.JobID)
+		if err != nil {
+			return err
+		}
+		// Загрузку удалили или миниатюра уже создана при прошлой доставке - подтверждаем без работы
+		if !started {
+			m.log.Info().Int("job_id", info.JobID).Msg("thumbnail job cancelled or already done, skipping")
+			return nil
+		}
+		m.publishEvent(info, models.JobStatusProcessing, "", nil)
+	}
 
-	// Открываем ранее сохраненную картинку
-	file, err := os.Open(info.Path)
+	// Статус ошибки выставляет FinishTask, он знает, будет ли повтор
+	thumbnail, err := m.createThumbnail(info)
 	if err != nil {
-		m.log.Error().Err(err).Msg("failed to open file...")
 		return err
 	}
-	// Получаем image.Image
-	imageData, _, err := image.Decode(file)
+
+	m.updateJob(info, models.JobStatusDone, "", thumbnail)
+	return nil
+}
+
+// Обновляем статус задачи и сообщаем о нем подписчикам, ошибку только логируем
+func (m *mediaService) updateJob(info *models.InfoForThumbnail, status string, jobErr string, thumbnail *models.Thumbnail) {
+	// Сообщения, отправленные до появления задач, идентификатора не содержат
+	if info.JobID == 0 {
+		return
+	}
+	if err := m.storage.UpdateThumbnailJob(context.Background(), info.JobID, status, jobErr); err != nil {
+		m.log.Error().Err(err).Int("job_id", info.JobID).Msg("failed to update thumbnail job")
+	}
+	m.publishEvent(info, status, jobErr, thumbnail)
+	m.enqueueWebhook(info, status, jobErr, thumbnail)
+}
+
+// Сообщаем вебхукам о готовой или окончательно упавшей миниатюре, ошибку только логируем
+func (m *mediaService) enqueueWebhook(info *models.InfoForThumbnail, status string, jobErr string, thumbnail *models.Thumbnail) {
+	var event string
+	switch status {
+	case models.JobStatusDone:
+		event = models.WebhookEventThumbnailCreated
+	case models.JobStatusFailed:
+		event = models.WebhookEventThumbnailFailed
+	default:
+		return
+	}
+	err := m.storage.EnqueueWebhookEvent(context.Background(), &models.WebhookEvent{
+		Event:     event,
+		UploadID:  info.UploadID,
+		JobID:     info.JobID,
+		Preset:    info.Preset,
+		Thumbnail: thumbnail,
+		Error:     jobErr,
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		m.log.Error().Err(err).Int("job_id", info.JobID).Msg("failed to enqueue webhook event")
+	}
+}
+
+// Публикуем событие о смене статуса задачи в media.events.<id загрузки>
+// Доставка не гарантируется, ошибку только логируем
+func (m *mediaService) publishEvent(info *models.InfoForThumbnail, status string, jobErr string, thumbnail *models.Thumbnail) {
+	if info.UploadID == 0 {
+		return
+	}
+	data, err := json.Marshal(models.ThumbnailEvent{
+		UploadID:  info.UploadID,
+		JobID:     info.JobID,
+		Preset:    info.Preset,
+		Status:    status,
+		Error:     jobErr,
+		Thumbnail: thumbnail,
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		m.log.Error().Err(err).Msg("failed to marshal thumbnail event")
+		return
+	}
+	if err = m.events.Publish(models.EventSubject(info.UploadID), data); err != nil {
+		m.log.Error().Err(err).Int("job_id", info.JobID).Msg("failed to publish thumbnail event")
+	}
+}
+
+// Считаем и сохраняем перцептивный хэш оригинала, ошибку только логируем
+// Хэш одинаков для всех пресетов, поэтому его считает первая задача загрузки, остальные пропускают
+func (m *mediaService) savePerceptualHash(uploadID int, img imaging.Image) {
+	if uploadID == 0 {
+		return
+	}
+	has, err := m.storage.HasPerceptualHash(context.Background(), uploadID)
+	if err != nil {
+		m.log.Error().Err(err).Int("upload_id", uploadID).Msg("failed to check perceptual hash")
+		return
+	}
+	if has {
+		return
+	}
+	hash, err := m.processor.DHash(img)
+	if err != nil {
+		m.log.Error().Err(err).Int("upload_id", uploadID).Msg("failed to compute perceptual hash")
+		return
+	}
+	if err = m.storage.SavePerceptualHash(context.Background(), uploadID, hash); err != nil {
+		m.log.Error().Err(err).Int("upload_id", uploadID).Msg("failed to save perceptual hash")
+	}
+}
+
+// Создание миниатюры через выбранную реализацию обработки изображений
+// Тут же сохраняем данные в БД, возвращаем сведения о миниатюре
+func (m *mediaService) createThumbnail(info *models.InfoForThumbnail) (*models.Thumbnail, error) {
+	if info.Size <= 0 {
+		return nil, permanent(fmt.Errorf("invalid thumbnail size %d", info.Size))
+	}
+
+	// Старые сообщения содержат путь на диске вместо имени
+	name := info.Name
+	if name == "" {
+		name = filepath.Base(info.Path)
+	}
+
+	// Открываем ранее сохраненную картинку через хранилище
+	file, _, err := m.objectStorage.Open(context.Background(), name)
+	if err != nil {
+		m.log.Error().Err(err).Msg("failed to open file...")
+		if errors.Is(err, models.ErrNotFound) {
+			return nil, permanent(err)
+		}
+		return nil, err
+	}
+	// Декодируем
+	img, err := m.processor.Decode(file)
 	if err != nil {
 		m.log.Error().Err(err).Msg("failed to decode...")
-		return err
+		file.Close()
+		// Битое изображение не исправится, а сбой чтения из хранилища стоит повторить
+		if errors.Is(err, imaging.ErrDecode) {
+			return nil, permanent(err)
+		}
+		return nil, err
 	}
+	defer img.Close()
 	// Закрываем файл
 	err = file.Close()
 	if err != nil {
 		m.log.Error().Err(err).Msg("failed to close file...")
-		return err
+		return nil, err
+	}
+	// Хэш для поиска похожих изображений, оригинал уже декодирован
+	m.savePerceptualHash(info.UploadID, img)
+	// Создаем миниатюру, ужимая по наибольшей стороне до размера пресета
+	newImage, err := m.processor.Resize(img, info.Size)
+	if err != nil {
+		m.log.Error().Err(err).Msg("failed to resize...")
+		return nil, err
 	}
-	// Создаем миниатюру
-	newImage := resize.Thumbnail(100, 100, imageData, resize.Lanczos3)
+	defer newImage.Close()
 
 	// Преобразуем в байты
-	buf := new(bytes.Buffer)
-	err = png.Encode(buf, newImage)
+	// Сообщения, отправленные до появления форматов, кодируем в PNG
+	format := info.Format
+	if format == "" {
+		format = imaging.FormatPNG
+	}
+	if !m.processor.Supports(format) {
+		return nil, permanent(fmt.Errorf("thumbnail format %q is not supported", format))
+	}
+	imgBytes, err := m.processor.Encode(newImage, format, info.Quality)
 	if err != nil {
 		m.log.Error().Err(err).Msg("failed to encode...")
-		return err
+		return nil, err
 	}
-	imgBytes := buf.Bytes()
 
-	// Создаем уникальное имя
-	pName := uuid.New().String()
+	// Создаем уникальное имя с расширением формата в каталоге арендатора
+	// Сообщения, отправленные до появления арендаторов, принадлежат DefaultTenant
+	tenant := info.Tenant
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+	if err = models.ValidateTenant(tenant); err != nil {
+		return nil, permanent(errors.Wrapf(err, "tenant %q", tenant))
+	}
+	pName := models.TenantObjectName(tenant, uuid.New().String()+imaging.Extension(format))
 
 	// Сохраняем миниатюру в память
-	if err = m.objectStorage.Save(imgBytes, fmt.Sprintf("%s.png", pName)); err != nil {
+	if err = m.objectStorage.Save(context.Background(), bytes.NewReader(imgBytes), pName); err != nil {
 		m.log.Error().Err(err).Msg("objectStorage.Save err")
-		return err
+		return nil, err
 	}
 
 	// Подготавливаем данные
-	dataMini := &models.ImageMeta{Name: fmt.Sprintf("%s.png", pName), Type: "png", Width: newImage.Bounds().Max.X, Height: newImage.Bounds().Max.Y}
+	meta := m.processor.Metadata(newImage)
+	dataMini := &models.ImageMeta{Name: pName, Type: format, Width: meta.Width, Height: meta.Height, Size: int64(len(imgBytes))}
 
 	// Сохраняем данные о миниатюре в БД
-	if err = m.storage.SaveFileMiniMeta(context.Background(), dataMini); err != nil {
+	if err = m.storage.SaveFileMiniMeta(context.Background(), info.UploadID, info.Preset, dataMini); err != nil {
 		m.log.Error().Err(err).Msg("failed to save data about mini to DB")
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &models.Thumbnail{Preset: info.Preset, Name: pName, Type: format, Width: meta.Width, Height: meta.Height}, nil
 }
 
-// То же самое, но только через Vips
-// func (m *mediaService) CreateThumbnail(info *models.InfoForThumbnail) error {
-// 	img, err := vips.NewImageFromFile(info.Path)
-
-// 	if err != nil {
-// 		m.log.Error().Err(err).Msg("NewImageFromFile err")
-// 		return err
-// 	}
-
-// 	err = img.Thumbnail(info.Size, info.Size, vips.InterestingNone)
-// 	if err != nil {
-// 		m.log.Error().Err(err).Msg("ResizeWithVScale err")
-// 		return err
-// 	}
-
-// 	pName := uuid.New().String()
-
-// 	imgBytes, _, err := img.ExportNative()
-// 	if err = m.objectStorage.Save(imgBytes, fmt.Sprintf("%s.png", pName)); err != nil {
-// 		m.log.Error().Err(err).Msg("objectStorage.Save err")
-// 		return err
-// 	}
-
-// 	return nil
-// }
-
-func New(log zerolog.Logger, storage Storage, objectStorage ObjectStorage, jsConsumer jetstream.Consumer) MediaService {
+func New(log zerolog.Logger, storage Storage, objectStorage ObjectStorage, jsConsumer jetstream.Consumer, js jetstream.JetStream, events EventPublisher, advisories Subscriber, processor imaging.ImageProcessor, maxDeliver int, backOff []time.Duration) MediaService {
 	return &mediaService{
 		log:           log,
 		storage:       storage,
 		objectStorage: objectStorage,
 		jsConsumer:    jsConsumer,
+		js:            js,
+		events:        events,
+		advisories:    advisories,
+		processor:     processor,
+		maxDeliver:    maxDeliver,
+		backOff:       backOff,
 	}
 }
@@ -0,0 +1,162 @@
+package media_service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-2/internal/imaging"
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog"
+)
+
+type fakeStorage struct {
+	Storage
+	jobs     map[int]string
+	webhooks []models.WebhookEvent
+	hashes   map[int]uint64
+}
+
+func (f *fakeStorage) UpdateThumbnailJob(_ context.Context, jobID int, status string, _ string) error {
+	f.jobs[jobID] = status
+	return nil
+}
+
+func (f *fakeStorage) EnqueueWebhookEvent(_ context.Context, event *models.WebhookEvent) error {
+	f.webhooks = append(f.webhooks, *event)
+	return nil
+}
+
+func (f *fakeStorage) HasPerceptualHash(_ context.Context, uploadID int) (bool, error) {
+	_, ok := f.hashes[uploadID]
+	return ok, nil
+}
+
+func (f *fakeStorage) SavePerceptualHash(_ context.Context, uploadID int, hash uint64) error {
+	if f.hashes == nil {
+		f.hashes = map[int]uint64{}
+	}
+	f.hashes[uploadID] = hash
+	return nil
+}
+
+// Считает вызовы DHash
+type fakeProcessor struct {
+	imaging.ImageProcessor
+	hashed int
+}
+
+func (f *fakeProcessor) DHash(imaging.Image) (uint64, error) {
+	f.hashed++
+	return 42, nil
+}
+
+type fakeEvents struct{}
+
+func (fakeEvents) Publish(string, []byte) error { return nil }
+
+// Поток с сообщениями по номерам
+type fakeStream struct {
+	jetstream.Stream
+	msgs map[uint64]*jetstream.RawStreamMsg
+}
+
+func (f *fakeStream) GetMsg(_ context.Context, seq uint64, _ ...jetstream.GetMsgOpt) (*jetstream.RawStreamMsg, error) {
+	msg, ok := f.msgs[seq]
+	if !ok {
+		return nil, jetstream.ErrMsgNotFound
+	}
+	return msg, nil
+}
+
+func (f *fakeStream) DeleteMsg(_ context.Context, seq uint64) error {
+	if _, ok := f.msgs[seq]; !ok {
+		return jetstream.ErrMsgNotFound
+	}
+	delete(f.msgs, seq)
+	return nil
+}
+
+type fakeJetStream struct {
+	jetstream.JetStream
+	stream    *fakeStream
+	published []*nats.Msg
+}
+
+func (f *fakeJetStream) Stream(context.Context, string) (jetstream.Stream, error) {
+	return f.stream, nil
+}
+
+func (f *fakeJetStream) PublishMsg(_ context.Context, msg *nats.Msg, _ ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	f.published = append(f.published, msg)
+	return &jetstream.PubAck{}, nil
+}
+
+func advisory(t *testing.T, seq uint64) *nats.Msg {
+	t.Helper()
+	data, err := json.Marshal(maxDeliveriesAdvisory{Stream: "EVENTS", Consumer: "media_service", StreamSeq: seq, Deliveries: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &nats.Msg{Data: data}
+}
+
+// Задача, на которую воркер не ответил за все доставки, попадает в очередь недоставленных и отмечается неудачной
+func TestHandleMaxDeliveries(t *testing.T) {
+	payload, _ := json.Marshal(models.InfoForThumbnail{JobID: 7, UploadID: 3, Tenant: "acme"})
+	stream := &fakeStream{msgs: map[uint64]*jetstream.RawStreamMsg{
+		42: {Subject: "media.acme.picture", Sequence: 42, Data: payload},
+	}}
+	js := &fakeJetStream{stream: stream}
+	storage := &fakeStorage{jobs: make(map[int]string)}
+	m := &mediaService{log: zerolog.Nop(), storage: storage, js: js, events: fakeEvents{}}
+
+	m.handleMaxDeliveries(advisory(t, 42))
+
+	if len(js.published) != 1 {
+		t.Fatalf("published %d dead letters, want 1", len(js.published))
+	}
+	dlq := js.published[0]
+	if dlq.Subject != "media.dlq.acme.picture" || string(dlq.Data) != string(payload) {
+		t.Fatalf("dead letter = %s %s", dlq.Subject, dlq.Data)
+	}
+	if dlq.Header.Get(models.HeaderDeadLetterAttempts) != "5" || dlq.Header.Get(models.HeaderDeadLetterSubject) != "media.acme.picture" {
+		t.Fatalf("dead letter headers = %v", dlq.Header)
+	}
+	if storage.jobs[7] != models.JobStatusFailed {
+		t.Fatalf("job status = %q, want failed", storage.jobs[7])
+	}
+	if len(storage.webhooks) != 1 || storage.webhooks[0].Event != models.WebhookEventThumbnailFailed {
+		t.Fatalf("webhook events = %+v, want one thumbnail failed", storage.webhooks)
+	}
+	if _, ok := stream.msgs[42]; ok {
+		t.Fatal("undelivered task left in stream")
+	}
+
+	// Сообщение уже удалено - повторное уведомление ничего не делает
+	m.handleMaxDeliveries(advisory(t, 42))
+	if len(js.published) != 1 {
+		t.Fatalf("published %d dead letters after repeated advisory, want 1", len(js.published))
+	}
+}
+
+// Хэш оригинала считается один раз на загрузку, а не на каждый пресет
+func TestSavePerceptualHashOncePerUpload(t *testing.T) {
+	storage := &fakeStorage{}
+	processor := &fakeProcessor{}
+	m := &mediaService{log: zerolog.Nop(), storage: storage, processor: processor}
+
+	// Три задачи пресетов одной загрузки
+	for i := 0; i < 3; i++ {
+		m.savePerceptualHash(7, nil)
+	}
+
+	if processor.hashed != 1 {
+		t.Fatalf("hash computed %d times, want 1", processor.hashed)
+	}
+	if storage.hashes[7] != 42 {
+		t.Fatalf("hash = %d, want 42", storage.hashes[7])
+	}
+}
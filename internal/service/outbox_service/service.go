@@ -0,0 +1,147 @@
+package outbox_service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog"
+)
+
+type Storage interface {
+	// Получаем неотправленные сообщения
+	GetOutbox(ctx context.Context, limit int) ([]models.OutboxMessage, error)
+	// Удаляем отправленное сообщение
+	DeleteOutbox(ctx context.Context, id int64) error
+	// Запоминаем неудачную попытку отправки
+	FailOutbox(ctx context.Context, id int64, sendErr string) error
+}
+
+type OutboxRelay interface {
+	// Запускаем отправку сообщений в фоне
+	Start()
+	// Останавливаем отправку и ждем завершения, но не дольше, чем позволяет ctx
+	Stop(ctx context.Context) error
+	// Будим отправку, не дожидаясь очередного опроса
+	Notify()
+}
+
+type outboxRelay struct {
+	log          zerolog.Logger
+	storage      Storage
+	js           jetstream.JetStream
+	pollInterval time.Duration
+	batchSize    int
+
+	notify chan struct{}
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Запускаем отправку сообщений в фоне
+func (o *outboxRelay) Start() {
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		ticker := time.NewTicker(o.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-o.notify:
+			case <-o.quit:
+				return
+			}
+			o.relay()
+		}
+	}()
+}
+
+// Останавливаем отправку и ждем завершения, но не дольше, чем позволяет ctx
+func (o *outboxRelay) Stop(ctx context.Context) error {
+	close(o.quit)
+
+	done := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Будим отправку, не дожидаясь очередного опроса
+func (o *outboxRelay) Notify() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Отправляем накопившиеся сообщения, пока они есть
+func (o *outboxRelay) relay() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		sent, err := o.relayBatch(ctx)
+		cancel()
+		if err != nil {
+			o.log.Error().Err(err).Msg("failed to relay outbox")
+			return
+		}
+		if sent < o.batchSize {
+			return
+		}
+	}
+}
+
+// Отправляем одну пачку сообщений, возвращаем число отправленных
+func (o *outboxRelay) relayBatch(ctx context.Context) (int, error) {
+	messages, err := o.storage.GetOutbox(ctx, o.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, msg := range messages {
+		// Nats-Msg-Id защищает от дублей, если сообщение ушло, а удалить запись не успели
+		natsMsg := nats.NewMsg(msg.Subject)
+		natsMsg.Data = msg.Payload
+		natsMsg.Header.Set(nats.MsgIdHdr, msg.MsgID)
+
+		if _, err = o.js.PublishMsg(ctx, natsMsg); err != nil {
+			if failErr := o.storage.FailOutbox(ctx, msg.ID, err.Error()); failErr != nil {
+				o.log.Error().Err(failErr).Int64("outbox_id", msg.ID).Msg("failed to save outbox error")
+			}
+			// Сохраняем порядок: остальные отправим в следующий раз
+			return sent, err
+		}
+
+		if err = o.storage.DeleteOutbox(ctx, msg.ID); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+func New(log zerolog.Logger, storage Storage, js jetstream.JetStream, pollInterval time.Duration, batchSize int) OutboxRelay {
+	return &outboxRelay{
+		log:          log,
+		storage:      storage,
+		js:           js,
+		pollInterval: pollInterval,
+		batchSize:    batchSize,
+		notify:       make(chan struct{}, 1),
+		quit:         make(chan struct{}),
+	}
+}
@@ -0,0 +1,145 @@
+package purge_service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/rs/zerolog"
+)
+
+type Storage interface {
+	// Получаем загрузки, удаленные раньше чем window назад
+	GetExpiredUploads(ctx context.Context, window time.Duration, limit int) ([]models.ExpiredUpload, error)
+	// Окончательно удаляем загрузку вместе с миниатюрами и задачами
+	PurgeUpload(ctx context.Context, id int) error
+	// Откладываем очистку загрузки после ошибки: backoff, удваиваясь с каждой попыткой, но не больше maxBackoff
+	MarkPurgeFailed(ctx context.Context, id int, reason string, backoff time.Duration, maxBackoff time.Duration) error
+}
+
+// Дольше этого неудачная загрузка не откладывается
+const maxPurgeBackoff = 24 * time.Hour
+
+type ObjectStorage interface {
+	// Удаляем изображение из хранилища, отсутствие файла ошибкой не считается
+	Delete(ctx context.Context, name string) error
+}
+
+type Purger interface {
+	// Запускаем очистку в фоне
+	Start()
+	// Останавливаем очистку и ждем завершения, но не дольше, чем позволяет ctx
+	Stop(ctx context.Context) error
+}
+
+type purger struct {
+	log           zerolog.Logger
+	storage       Storage
+	objectStorage ObjectStorage
+	window        time.Duration
+	interval      time.Duration
+	batchSize     int
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Запускаем очистку в фоне
+func (p *purger) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-p.quit:
+				return
+			}
+			p.purge()
+		}
+	}()
+}
+
+// Останавливаем очистку и ждем завершения, но не дольше, чем позволяет ctx
+func (p *purger) Stop(ctx context.Context) error {
+	close(p.quit)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Удаляем просроченные загрузки, пока они есть
+func (p *purger) purge() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		processed, err := p.purgeBatch(ctx)
+		cancel()
+		if err != nil {
+			p.log.Error().Err(err).Msg("failed to purge uploads")
+			return
+		}
+		if processed < p.batchSize {
+			return
+		}
+	}
+}
+
+// Обрабатываем одну пачку загрузок, возвращаем их число
+// Загрузка с ошибкой пропускается и откладывается, чтобы не останавливать очистку остальных
+func (p *purger) purgeBatch(ctx context.Context) (int, error) {
+	uploads, err := p.storage.GetExpiredUploads(ctx, p.window, p.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, upload := range uploads {
+		if err = p.purgeUpload(ctx, upload); err != nil {
+			p.log.Error().Err(err).Int("upload_id", upload.ID).Msg("failed to purge upload")
+			// Неотложенная загрузка вернулась бы в следующую пачку, поэтому без отметки прерываемся до следующего тика
+			if err = p.storage.MarkPurgeFailed(ctx, upload.ID, err.Error(), p.interval, maxPurgeBackoff); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		p.log.Info().Int("upload_id", upload.ID).Msg("upload purged")
+	}
+
+	return len(uploads), nil
+}
+
+// Сначала файлы, потом запись: если упадем посередине, запись останется и очистка повторится
+func (p *purger) purgeUpload(ctx context.Context, upload models.ExpiredUpload) error {
+	for _, name := range upload.Files {
+		if err := p.objectStorage.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return p.storage.PurgeUpload(ctx, upload.ID)
+}
+
+func New(log zerolog.Logger, storage Storage, objectStorage ObjectStorage, window time.Duration, interval time.Duration, batchSize int) Purger {
+	return &purger{
+		log:           log,
+		storage:       storage,
+		objectStorage: objectStorage,
+		window:        window,
+		interval:      interval,
+		batchSize:     batchSize,
+		quit:          make(chan struct{}),
+	}
+}
@@ -0,0 +1,403 @@
+package webhook_service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Заголовки запроса к вебхуку
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	// sha256=<hex HMAC-SHA256 от "<timestamp>.<тело>">
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+type Storage interface {
+	// Регистрируем вебхук
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+	// Получаем вебхуки владельца без ключей
+	GetWebhooks(ctx context.Context, owner models.Owner) ([]models.Webhook, error)
+	// Удаляем вебхук владельца вместе с журналом доставки
+	DeleteWebhook(ctx context.Context, owner models.Owner, id int) error
+	// Получаем журнал доставки вебхука владельца, пустой статус - все
+	GetWebhookDeliveries(ctx context.Context, owner models.Owner, webhookID int, status string, limit int) ([]models.WebhookDelivery, error)
+	// Забираем доставки, время попытки которых подошло, до следующей попытки не позже чем через lease
+	ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	// Отмечаем успешную доставку
+	MarkWebhookDelivered(ctx context.Context, id int64, statusCode int) error
+	// Запоминаем неудачную попытку доставки
+	FailWebhookDelivery(ctx context.Context, id int64, statusCode int, deliveryErr string, retryIn time.Duration, final bool) error
+}
+
+type WebhookService interface {
+	// Запускаем доставку в фоне
+	Start()
+	// Останавливаем доставку и ждем завершения, но не дольше, чем позволяет ctx
+	Stop(ctx context.Context) error
+	// Регистрируем вебхук, пустой ключ генерируется
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+	// Получаем зарегистрированные вебхуки
+	GetWebhooks(ctx context.Context) ([]models.Webhook, error)
+	// Удаляем вебхук
+	DeleteWebhook(ctx context.Context, id int) error
+	// Получаем журнал доставки вебхука
+	GetDeliveries(ctx context.Context, webhookID int, status string, limit int) ([]models.WebhookDelivery, error)
+}
+
+// Настройки доставки
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	Timeout      time.Duration
+	MaxAttempts  int
+	// Задержка перед второй попыткой, дальше удваивается до MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Разрешить адреса внутренних сетей, только для локальной разработки
+	AllowPrivate bool
+}
+
+// Сети, кроме частных, loopback и link-local, куда вебхуки не отправляются
+var blockedPrefixes = []netip.Prefix{
+	// "Этот" хост и общий адрес провайдеров (CGNAT)
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// Служебные и тестовые сети
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// IPv4, встроенный в IPv6 (NAT64)
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// Можно ли отправлять вебхук на адрес: внутренние адреса сервиса, включая
+// метаданные облака 169.254.169.254, вызывающему недоступны
+func allowedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Проверяем адрес при подключении: DNS мог поменяться после регистрации вебхука
+func dialControl(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !allowedAddr(addr) {
+		return fmt.Errorf("webhook address %s is not allowed", addr)
+	}
+	return nil
+}
+
+type webhookService struct {
+	log      zerolog.Logger
+	storage  Storage
+	client   *http.Client
+	resolver *net.Resolver
+	cfg      Config
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Запускаем доставку в фоне
+func (w *webhookService) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(w.cfg.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.quit:
+				return
+			}
+			w.deliver()
+		}
+	}()
+}
+
+// Останавливаем доставку и ждем завершения, но не дольше, чем позволяет ctx
+func (w *webhookService) Stop(ctx context.Context) error {
+	close(w.quit)
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Регистрируем вебхук владельца из контекста, пустой ключ генерируется
+// Вебхук получает события только о загрузках своего владельца
+func (w *webhookService) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	webhook.TenantID, webhook.OwnerID = owner.TenantID, owner.OwnerID
+
+	u, parseErr := url.Parse(webhook.URL)
+	if parseErr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.Wrapf(models.ErrInvalidWebhook, "invalid url %q", webhook.URL)
+	}
+	if err = w.checkHost(ctx, u.Hostname()); err != nil {
+		return err
+	}
+	if webhook.Events == nil {
+		webhook.Events = make([]string, 0)
+	}
+	for _, event := range webhook.Events {
+		if !knownEvent(event) {
+			return errors.Wrapf(models.ErrInvalidWebhook, "unknown event %q", event)
+		}
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return errors.Wrap(err, "failed to generate webhook secret")
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	return w.storage.CreateWebhook(ctx, webhook)
+}
+
+// Все адреса хоста должны быть внешними, иначе вебхук позволил бы обращаться во внутреннюю сеть
+func (w *webhookService) checkHost(ctx context.Context, host string) error {
+	if w.cfg.AllowPrivate {
+		return nil
+	}
+
+	addrs, err := w.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return errors.Wrapf(models.ErrInvalidWebhook, "failed to resolve %q: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !allowedAddr(addr) {
+			return errors.Wrapf(models.ErrInvalidWebhook, "host %q resolves to internal address %s", host, addr)
+		}
+	}
+
+	return nil
+}
+
+func knownEvent(event string) bool {
+	for _, known := range models.WebhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Получаем зарегистрированные вебхуки
+func (w *webhookService) GetWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.storage.GetWebhooks(ctx, owner)
+}
+
+// Удаляем вебхук
+func (w *webhookService) DeleteWebhook(ctx context.Context, id int) error {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return w.storage.DeleteWebhook(ctx, owner, id)
+}
+
+// Получаем журнал доставки вебхука
+func (w *webhookService) GetDeliveries(ctx context.Context, webhookID int, status string, limit int) ([]models.WebhookDelivery, error) {
+	owner, err := models.OwnerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.storage.GetWebhookDeliveries(ctx, owner, webhookID, status, limit)
+}
+
+// Отправляем доставки, время которых подошло, пока они есть
+func (w *webhookService) deliver() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		deliveries, err := w.storage.ClaimDueWebhookDeliveries(ctx, w.cfg.BatchSize, w.lease())
+		cancel()
+		if err != nil {
+			w.log.Error().Err(err).Msg("failed to get webhook deliveries")
+			return
+		}
+
+		for _, delivery := range deliveries {
+			select {
+			case <-w.quit:
+				return
+			default:
+			}
+			w.send(delivery)
+		}
+		if len(deliveries) < w.cfg.BatchSize {
+			return
+		}
+	}
+}
+
+// На сколько забираем пачку: доставки идут по очереди, каждая не дольше Timeout
+func (w *webhookService) lease() time.Duration {
+	return w.cfg.Timeout*time.Duration(w.cfg.BatchSize) + time.Minute
+}
+
+// Одна попытка доставки с записью результата в журнал
+func (w *webhookService) send(delivery models.WebhookDelivery) {
+	statusCode, err := w.post(delivery)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err == nil {
+		if err = w.storage.MarkWebhookDelivered(ctx, delivery.ID, statusCode); err != nil {
+			w.log.Error().Err(err).Int64("delivery_id", delivery.ID).Msg("failed to mark webhook delivered")
+		}
+		return
+	}
+
+	attempt := delivery.Attempts + 1
+	final := attempt >= w.cfg.MaxAttempts
+	w.log.Warn().Err(err).Int64("delivery_id", delivery.ID).Int("attempt", attempt).Bool("final", final).Msg("webhook delivery failed")
+	if err = w.storage.FailWebhookDelivery(ctx, delivery.ID, statusCode, err.Error(), w.backoff(attempt), final); err != nil {
+		w.log.Error().Err(err).Int64("delivery_id", delivery.ID).Msg("failed to save webhook delivery failure")
+	}
+}
+
+// Задержка после попытки: BaseBackoff * 2^(attempt-1), не больше MaxBackoff
+func (w *webhookService) backoff(attempt int) time.Duration {
+	delay := w.cfg.BaseBackoff
+	for i := 1; i < attempt && delay < w.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > w.cfg.MaxBackoff {
+		delay = w.cfg.MaxBackoff
+	}
+
+	return delay
+}
+
+// Отправляем подписанный запрос, успех - любой код 2xx
+func (w *webhookService) post(delivery models.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create request")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Читаем начало ответа для журнала, остальное пропускаем, чтобы соединение переиспользовалось
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Подпись запроса: hex HMAC-SHA256 от "<timestamp>.<тело>"
+// Метка времени в подписи не дает повторить старый запрос
+func Sign(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func New(log zerolog.Logger, storage Storage, cfg Config) WebhookService {
+	return &webhookService{
+		log:      log,
+		storage:  storage,
+		client:   newClient(cfg),
+		resolver: net.DefaultResolver,
+		cfg:      cfg,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Клиент без прокси и переадресаций, адрес проверяется при каждом подключении
+func newClient(cfg Config) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout, KeepAlive: 30 * time.Second}
+	if !cfg.AllowPrivate {
+		dialer.Control = dialControl
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Через прокси проверялся бы адрес прокси, а не получателя
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+		// Переадресация увела бы запрос на непроверенный адрес
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errors.New("webhook redirects are not followed")
+		},
+	}
+}
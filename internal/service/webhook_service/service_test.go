@@ -0,0 +1,116 @@
+package webhook_service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Хранилище, которое только запоминает созданные вебхуки
+type fakeStorage struct {
+	Storage
+	created []models.Webhook
+}
+
+func (f *fakeStorage) CreateWebhook(_ context.Context, webhook *models.Webhook) error {
+	f.created = append(f.created, *webhook)
+	return nil
+}
+
+func testContext() context.Context {
+	return models.WithPrincipal(context.Background(), &models.Principal{TenantID: "default", OwnerID: "alice"})
+}
+
+func TestAllowedAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00:ec2::254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		if got := allowedAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("allowedAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCreateWebhookRejectsInternalHosts(t *testing.T) {
+	storage := &fakeStorage{}
+	svc := New(zerolog.Nop(), storage, Config{Timeout: time.Second})
+
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"ftp://example.com/hook",
+		"http:///hook",
+	} {
+		err := svc.CreateWebhook(testContext(), &models.Webhook{URL: url})
+		if !errors.Is(err, models.ErrInvalidWebhook) {
+			t.Errorf("CreateWebhook(%s) error = %v, want ErrInvalidWebhook", url, err)
+		}
+	}
+	if len(storage.created) != 0 {
+		t.Fatalf("created %d webhooks, want 0", len(storage.created))
+	}
+
+	// Для локальной разработки внутренние адреса можно разрешить
+	svc = New(zerolog.Nop(), storage, Config{Timeout: time.Second, AllowPrivate: true})
+	if err := svc.CreateWebhook(testContext(), &models.Webhook{URL: "http://127.0.0.1:8080/hook"}); err != nil {
+		t.Fatalf("CreateWebhook with AllowPrivate: %v", err)
+	}
+}
+
+func TestClientRefusesInternalAddressesAndRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer redirect.Close()
+
+	// Адрес проверяется при подключении, даже если при регистрации DNS указывал наружу
+	client := newClient(Config{Timeout: time.Second})
+	_, err := client.Get(target.URL)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("Get loopback error = %v, want refused dial", err)
+	}
+
+	// httptest слушает loopback, поэтому переадресацию проверяем с разрешенными внутренними адресами
+	client = newClient(Config{Timeout: time.Second, AllowPrivate: true})
+	if _, err = client.Get(redirect.URL); err == nil || !strings.Contains(err.Error(), "redirects are not followed") {
+		t.Fatalf("Get redirect error = %v, want refused redirect", err)
+	}
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatalf("Get with AllowPrivate: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,194 @@
+package object_storage
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Настройки S3-совместимого хранилища
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	Bucket    string
+	// Префикс ключей внутри бакета
+	Prefix string
+	// Размер части при multipart загрузке, 0 - по умолчанию
+	PartSize uint64
+}
+
+// Хранилище в S3-совместимом бакете
+type s3Storage struct {
+	log      zerolog.Logger
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// Сохранение изображения в хранилище
+// Размер заранее неизвестен, поэтому данные загружаются частями по partSize (multipart)
+func (s *s3Storage) Save(ctx context.Context, r io.Reader, name string) error {
+	// Тип содержимого определяем по первым байтам, не читая поток целиком
+	br := bufio.NewReaderSize(r, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return errors.Wrap(err, "failed to read data")
+	}
+
+	opts := minio.PutObjectOptions{
+		ContentType: http.DetectContentType(head),
+		PartSize:    s.partSize,
+	}
+
+	_, err = s.client.PutObject(ctx, s.bucket, s.key(name), br, -1, opts)
+	if err != nil {
+		return errors.Wrap(err, "failed to put object")
+	}
+
+	return nil
+}
+
+// Открываем изображение для чтения
+func (s *s3Storage) Open(ctx context.Context, name string) (io.ReadSeekCloser, *models.ObjectInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s.wrapErr(err, "failed to get object")
+	}
+
+	// GetObject ленивый: ошибки вроде отсутствия ключа видны только после Stat
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, s.wrapErr(err, "failed to stat object")
+	}
+
+	return obj, &models.ObjectInfo{Name: name, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+// Читаем изображение целиком
+func (s *s3Storage) Get(ctx context.Context, name string) ([]byte, error) {
+	obj, _, err := s.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read object")
+	}
+
+	return data, nil
+}
+
+// Получаем сведения об изображении
+func (s *s3Storage) Stat(ctx context.Context, name string) (*models.ObjectInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.wrapErr(err, "failed to stat object")
+	}
+
+	return &models.ObjectInfo{Name: name, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+// Проверяем, есть ли изображение
+func (s *s3Storage) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.Stat(ctx, name)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Удаляем изображение, отсутствие изображения ошибкой не считается
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{}); err != nil {
+		return errors.Wrap(err, "failed to remove object")
+	}
+
+	return nil
+}
+
+// Получаем сведения об изображениях, имена которых начинаются с prefix
+// Рекурсивно, чтобы попали ключи в префиксах арендаторов
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]models.ObjectInfo, error) {
+	// Ключи в бакете содержат общий префикс хранилища, в ответе он не нужен
+	keyPrefix := s.key("")
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+
+	var objects = make([]models.ObjectInfo, 0)
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: keyPrefix + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, errors.Wrap(obj.Err, "failed to list objects")
+		}
+		objects = append(objects, models.ObjectInfo{
+			Name:    strings.TrimPrefix(obj.Key, keyPrefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+
+	return objects, nil
+}
+
+// Ключ объекта с учетом префикса
+func (s *s3Storage) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// Отсутствующий ключ превращаем в models.ErrNotFound
+func (s *s3Storage) wrapErr(err error, msg string) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return models.ErrNotFound
+	}
+	return errors.Wrap(err, msg)
+}
+
+// Хранилище в S3-совместимом бакете, бакет создается при отсутствии
+func NewS3(ctx context.Context, log zerolog.Logger, cfg S3Config) (ObjectStorage, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create s3 client")
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check bucket")
+	}
+	if !exists {
+		if err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, errors.Wrap(err, "failed to create bucket")
+		}
+	}
+
+	return &s3Storage{
+		log:      log,
+		client:   client,
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+		partSize: cfg.PartSize,
+	}, nil
+}
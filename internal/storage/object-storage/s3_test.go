@@ -0,0 +1,377 @@
+package object_storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// Минимальная замена S3 для тестов: бакеты, объекты, multipart и ListObjectsV2, подписи не проверяются
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]map[int][]byte
+	// Сколько multipart загрузок завершено
+	completed int
+	nextID    int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		buckets: make(map[string]map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	objects, ok := f.buckets[bucket]
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodPut:
+			f.buckets[bucket] = make(map[string][]byte)
+		case !ok:
+			s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		case r.Method == http.MethodHead:
+		case query.Has("location"):
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+			}{})
+		case query.Get("list-type") == "2":
+			f.list(w, objects, query.Get("prefix"))
+		default:
+			s3Error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		uploadID := strconv.Itoa(f.nextID)
+		f.uploads[uploadID] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, parts[number]...)
+		}
+		objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		f.completed++
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		objects[key] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		http.ServeContent(w, r, key, time.Unix(1700000000, 0), bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, objects map[string][]byte, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Prefix: prefix}
+	for key, data := range objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				Size:         int64(len(data)),
+				LastModified: time.Unix(1700000000, 0).UTC().Format(time.RFC3339),
+				ETag:         etag(data),
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+// Тело запроса, по http minio-go подписывает его кусками (aws-chunked)
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size)
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if _, err = br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+// Хранилище поверх fakeS3 с префиксом ключей и минимальным размером части
+func newTestS3(t *testing.T) (ObjectStorage, *fakeS3) {
+	t.Helper()
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	storage, err := NewS3(context.Background(), zerolog.Nop(), S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		AccessKey: "test",
+		SecretKey: "testtest",
+		Bucket:    "uploads",
+		Prefix:    "media",
+		PartSize:  5 << 20,
+	})
+	if err != nil {
+		t.Fatalf("NewS3: %v", err)
+	}
+
+	return storage, fake
+}
+
+func TestS3SaveMultipartAndOpen(t *testing.T) {
+	storage, fake := newTestS3(t)
+	ctx := context.Background()
+
+	// Больше двух частей по 5 МиБ
+	data := make([]byte, 11<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := storage.Save(ctx, bytes.NewReader(data), "default/big.png"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if fake.completed != 1 {
+		t.Fatalf("completed multipart uploads = %d, want 1", fake.completed)
+	}
+	if _, ok := fake.buckets["uploads"]["media/default/big.png"]; !ok {
+		t.Fatal("object is not stored under the bucket prefix")
+	}
+
+	content, info, err := storage.Open(ctx, "default/big.png")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer content.Close()
+	got, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content differs from saved data")
+	}
+	if info.Name != "default/big.png" || info.Size != int64(len(data)) {
+		t.Fatalf("info = %+v", info)
+	}
+}
+
+func TestS3StatExistsDelete(t *testing.T) {
+	storage, _ := newTestS3(t)
+	ctx := context.Background()
+
+	if err := storage.Save(ctx, strings.NewReader("small"), "a.png"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	info, err := storage.Stat(ctx, "a.png")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Name != "a.png" || info.Size != 5 {
+		t.Fatalf("info = %+v", info)
+	}
+	data, err := storage.Get(ctx, "a.png")
+	if err != nil || string(data) != "small" {
+		t.Fatalf("Get = %q, %v", data, err)
+	}
+
+	exists, err := storage.Exists(ctx, "a.png")
+	if err != nil || !exists {
+		t.Fatalf("Exists = %v, %v, want true", exists, err)
+	}
+
+	if err = storage.Delete(ctx, "a.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	// Повторное удаление ошибкой не считается
+	if err = storage.Delete(ctx, "a.png"); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+	exists, err = storage.Exists(ctx, "a.png")
+	if err != nil || exists {
+		t.Fatalf("Exists after Delete = %v, %v, want false", exists, err)
+	}
+}
+
+func TestS3NotFound(t *testing.T) {
+	storage, _ := newTestS3(t)
+	ctx := context.Background()
+
+	if _, _, err := storage.Open(ctx, "missing.png"); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("Open error = %v, want ErrNotFound", err)
+	}
+	if _, err := storage.Stat(ctx, "missing.png"); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("Stat error = %v, want ErrNotFound", err)
+	}
+	if _, err := storage.Get(ctx, "missing.png"); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("Get error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	storage, fake := newTestS3(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"a.png", "t1/b.png", "t1/c.png", "t2/d.png"} {
+		if err := storage.Save(ctx, strings.NewReader(name), name); err != nil {
+			t.Fatalf("Save %s: %v", name, err)
+		}
+	}
+	// Чужой ключ вне префикса хранилища в список попасть не должен
+	fake.buckets["uploads"]["other/e.png"] = []byte("e")
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "", want: []string{"a.png", "t1/b.png", "t1/c.png", "t2/d.png"}},
+		{prefix: "t1/", want: []string{"t1/b.png", "t1/c.png"}},
+		{prefix: "t", want: []string{"t1/b.png", "t1/c.png", "t2/d.png"}},
+		{prefix: "x", want: nil},
+	}
+	for _, tt := range tests {
+		objects, err := storage.List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", tt.prefix, err)
+		}
+		var names []string
+		for _, object := range objects {
+			names = append(names, object.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, names, tt.want)
+		}
+	}
+}
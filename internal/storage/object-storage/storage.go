@@ -1,46 +1,252 @@
 package object_storage
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/Yury132/Golang-Task-2/internal/models"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 )
 
+// Доступные реализации хранилища
+const (
+	// Локальная папка
+	BackendFS = "fs"
+	// S3-совместимое хранилище (AWS S3, MinIO и т.п.)
+	BackendS3 = "s3"
+)
+
 type ObjectStorage interface {
-	// Сохранение изображения в хранилище
-	Save(data []byte, name string) error
+	// Сохранение изображения в хранилище, данные читаются потоком
+	Save(ctx context.Context, r io.Reader, name string) error
+	// Читаем изображение целиком
+	Get(ctx context.Context, name string) ([]byte, error)
+	// Открываем изображение для чтения
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, *models.ObjectInfo, error)
+	// Получаем сведения об изображении
+	Stat(ctx context.Context, name string) (*models.ObjectInfo, error)
+	// Проверяем, есть ли изображение
+	Exists(ctx context.Context, name string) (bool, error)
+	// Удаляем изображение, отсутствие изображения ошибкой не считается
+	Delete(ctx context.Context, name string) error
+	// Получаем сведения об изображениях, имена которых начинаются с prefix
+	List(ctx context.Context, prefix string) ([]models.ObjectInfo, error)
 }
 
+// Хранилище в локальной папке
 type objectStorage struct {
 	log zerolog.Logger
+	dir string
 }
 
 // Сохранение изображения в хранилище
-func (o *objectStorage) Save(data []byte, name string) error {
-	path := fmt.Sprintf("uploads/%s", name)
+// Пишем во временный файл и переименовываем, чтобы оборванная загрузка не оставила обрезанный файл
+// Папка арендатора создается при первой записи
+func (o *objectStorage) Save(_ context.Context, r io.Reader, name string) error {
+	path, err := o.path(name)
+	if err != nil {
+		return err
+	}
 
-	f, err := os.Create(path)
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrap(err, "failed to create dir")
+	}
+	// Временный файл в той же папке, иначе переименование может оказаться переносом между дисками
+	f, err := os.CreateTemp(dir, ".upload-*")
 	if err != nil {
 		return errors.Wrap(err, "failed to create file")
 	}
 	defer func() {
-		if err = f.Close(); err != nil {
+		// После успешного переименования временного файла уже нет
+		if err = os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
 			o.log.Error().Err(err).Send()
 		}
 	}()
 
-	_, err = f.Write(data)
-	if err != nil {
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
 		return errors.Wrap(err, "failed to write data to file")
 	}
+	if err = f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+
+	if err = os.Rename(f.Name(), path); err != nil {
+		return errors.Wrap(err, "failed to rename file")
+	}
+
+	return nil
+}
+
+// Читаем изображение целиком
+func (o *objectStorage) Get(_ context.Context, name string) ([]byte, error) {
+	path, err := o.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, o.wrapErr(err, "failed to read file")
+	}
+
+	return data, nil
+}
+
+// Открываем изображение для чтения
+func (o *objectStorage) Open(_ context.Context, name string) (io.ReadSeekCloser, *models.ObjectInfo, error) {
+	path, err := o.path(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, o.wrapErr(err, "failed to open file")
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "failed to stat file")
+	}
+
+	return f, objectInfo(name, stat), nil
+}
+
+// Получаем сведения об изображении
+func (o *objectStorage) Stat(_ context.Context, name string) (*models.ObjectInfo, error) {
+	path, err := o.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, o.wrapErr(err, "failed to stat file")
+	}
+
+	return objectInfo(name, stat), nil
+}
+
+// Проверяем, есть ли изображение
+func (o *objectStorage) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := o.Stat(ctx, name)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Удаляем изображение, отсутствие изображения ошибкой не считается
+func (o *objectStorage) Delete(_ context.Context, name string) error {
+	path, err := o.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to delete file")
+	}
 
 	return nil
 }
 
-func New(log zerolog.Logger) ObjectStorage {
+// Получаем сведения об изображениях, имена которых начинаются с prefix
+// Файлы в папках арендаторов возвращаются с именем "арендатор/файл"
+func (o *objectStorage) List(_ context.Context, prefix string) ([]models.ObjectInfo, error) {
+	var objects = make([]models.ObjectInfo, 0)
+	if err := o.list("", prefix, &objects); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects, nil
+}
+
+// Добавляем в objects файлы папки dir (пустая - корень хранилища) и ее подпапок
+func (o *objectStorage) list(dir string, prefix string, objects *[]models.ObjectInfo) error {
+	entries, err := os.ReadDir(filepath.Join(o.dir, dir))
+	if err != nil {
+		return errors.Wrap(err, "failed to read dir")
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if dir != "" {
+			name = dir + "/" + name
+		}
+		if entry.IsDir() {
+			// Папки есть только у арендаторов в корне, глубже не спускаемся
+			if dir == "" && (strings.HasPrefix(name, prefix) || strings.HasPrefix(prefix, name+"/")) {
+				if err = o.list(name, prefix, objects); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// Временные файлы незавершенных загрузок пропускаем
+		if strings.HasPrefix(entry.Name(), ".upload-") || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			// Файл могли удалить между чтением папки и Info
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrap(err, "failed to stat file")
+		}
+		*objects = append(*objects, *objectInfo(name, stat))
+	}
+
+	return nil
+}
+
+// Путь к файлу: имя в корне или "арендатор/имя", выйти за пределы папки нельзя
+func (o *objectStorage) path(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) > 2 {
+		return "", errors.Errorf("invalid object name %q", name)
+	}
+	for _, part := range parts {
+		if part == "" || part != filepath.Base(part) || part == "." || part == ".." {
+			return "", errors.Errorf("invalid object name %q", name)
+		}
+	}
+
+	return filepath.Join(o.dir, filepath.Join(parts...)), nil
+}
+
+// Отсутствующий файл превращаем в models.ErrNotFound
+func (o *objectStorage) wrapErr(err error, msg string) error {
+	if os.IsNotExist(err) {
+		return models.ErrNotFound
+	}
+	return errors.Wrap(err, msg)
+}
+
+func objectInfo(name string, stat os.FileInfo) *models.ObjectInfo {
+	return &models.ObjectInfo{Name: name, Size: stat.Size(), ModTime: stat.ModTime()}
+}
+
+// Хранилище в локальной папке dir
+func New(log zerolog.Logger, dir string) ObjectStorage {
 	return &objectStorage{
 		log: log,
+		dir: dir,
 	}
 }
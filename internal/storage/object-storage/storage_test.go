@@ -0,0 +1,110 @@
+package object_storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/rs/zerolog"
+)
+
+func TestPath(t *testing.T) {
+	o := &objectStorage{dir: "/data"}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"8f14e45f.png", "/data/8f14e45f.png"},
+		{"acme/8f14e45f-ceea-467f-a0e6-4d2f1e1a1b2c.png", "/data/acme/8f14e45f-ceea-467f-a0e6-4d2f1e1a1b2c.png"},
+		{"../x", ""},
+		{"..", ""},
+		{"./x", ""},
+		{"a/b/c", ""},
+		{"acme/", ""},
+		{"/x", ""},
+		{"acme//x.png", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := o.path(tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("path(%q) = %q, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("path(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestFSList(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	storage := New(zerolog.Nop(), dir)
+
+	for _, name := range []string{"legacy.png", "t1/a.png", "t1/b.png", "t2/c.png", "t10/d.png"} {
+		if err := storage.Save(ctx, strings.NewReader(name), name); err != nil {
+			t.Fatalf("Save(%s): %v", name, err)
+		}
+	}
+	// Оборванная загрузка и папки глубже арендатора в список не попадают
+	if err := os.WriteFile(filepath.Join(dir, "t1", ".upload-123"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "t1", "nested"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "t1", "nested", "e.png"), []byte("e"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"legacy.png", "t1/a.png", "t1/b.png", "t10/d.png", "t2/c.png"}},
+		{"t1/", []string{"t1/a.png", "t1/b.png"}},
+		{"t1", []string{"t1/a.png", "t1/b.png", "t10/d.png"}},
+		{"t1/a", []string{"t1/a.png"}},
+		{"legacy", []string{"legacy.png"}},
+		{"x", nil},
+	}
+	for _, tt := range tests {
+		objects, err := storage.List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", tt.prefix, err)
+		}
+		var names []string
+		for _, object := range objects {
+			names = append(names, object.Name)
+			if object.Size != int64(len(object.Name)) {
+				t.Errorf("List(%q): %s size = %d, want %d", tt.prefix, object.Name, object.Size, len(object.Name))
+			}
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, names, tt.want)
+		}
+	}
+}
+
+func TestFSNotFound(t *testing.T) {
+	ctx := context.Background()
+	storage := New(zerolog.Nop(), t.TempDir())
+
+	if _, err := storage.Stat(ctx, "acme/missing.png"); err != models.ErrNotFound {
+		t.Fatalf("Stat error = %v, want ErrNotFound", err)
+	}
+	if ok, err := storage.Exists(ctx, "acme/missing.png"); ok || err != nil {
+		t.Fatalf("Exists = %v, %v, want false, nil", ok, err)
+	}
+	if err := storage.Delete(ctx, "acme/missing.png"); err != nil {
+		t.Fatalf("Delete missing: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+)
+
+// Сохраняем API ключ, хранится только хэш
+func (s *storage) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := "INSERT INTO public.api_keys (tenant_id, owner_id, name, prefix, key_hash, admin) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at"
+	err := s.conn.QueryRow(ctxDb, query, key.TenantID, key.OwnerID, key.Name, key.Prefix, key.Hash, key.Admin).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return errors.Wrap(err, "failed to create api key")
+	}
+
+	return nil
+}
+
+// Ищем действующий ключ по хэшу
+func (s *storage) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := "SELECT id, tenant_id, owner_id, name, prefix, admin, created_at, revoked_at FROM public.api_keys WHERE key_hash = $1 AND revoked_at IS NULL"
+	key, err := scanAPIKey(s.conn.QueryRow(ctxDb, query, hash))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to get api key")
+	}
+
+	return key, nil
+}
+
+// Получаем ключи арендатора, включая отозванные, пустой арендатор - все
+func (s *storage) GetAPIKeys(ctx context.Context, tenant string) ([]models.APIKey, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := "SELECT id, tenant_id, owner_id, name, prefix, admin, created_at, revoked_at FROM public.api_keys WHERE $1 = '' OR tenant_id = $1 ORDER BY id"
+	rows, err := s.conn.Query(ctxDb, query, tenant)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get api keys")
+	}
+	defer rows.Close()
+
+	var keys = make([]models.APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan api key")
+		}
+		keys = append(keys, *key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read api keys")
+	}
+
+	return keys, nil
+}
+
+// Отзываем ключ арендатора, пустой арендатор - любой
+// Повторный отзыв и ключ другого арендатора - ErrNotFound
+func (s *storage) RevokeAPIKey(ctx context.Context, tenant string, id int) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := "UPDATE public.api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL AND ($2 = '' OR tenant_id = $2)"
+	tag, err := s.conn.Exec(ctxDb, query, id, tenant)
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke api key")
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
+
+func scanAPIKey(row pgx.Row) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := row.Scan(&key.ID, &key.TenantID, &key.OwnerID, &key.Name, &key.Prefix, &key.Admin, &key.CreatedAt, &key.RevokedAt); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
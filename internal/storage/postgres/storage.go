@@ -5,49 +5,256 @@ import (
 	"time"
 
 	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pkg/errors"
 )
 
 type Storage interface {
-	// Загрузка данных в БД об изначальных изображениях
-	SaveFileMeta(ctx context.Context, metaInfo *models.ImageMeta) error
+	// Загрузка данных в БД об изначальном изображении вместе с задачами и сообщениями для Nats
+	// Если загрузка с тем же содержимым уже есть и force не задан, возвращается она, без задач
+	// Новая загрузка сверх quota арендатора не сохраняется, ErrQuotaExceeded
+	SaveUpload(ctx context.Context, owner models.Owner, metaInfo *models.ImageMeta, force bool, quota models.Quota, presets []models.ThumbnailPreset, newMessage models.OutboxBuilder) (*models.SavedUpload, error)
+	// Получаем занятое арендатором место
+	GetTenantUsage(ctx context.Context, tenant string) (*models.TenantUsage, error)
 	// Загрузка данных в БД о миниатюрах
-	SaveFileMiniMeta(ctx context.Context, metaInfo *models.ImageMeta) error
+	SaveFileMiniMeta(ctx context.Context, uploadID int, preset string, metaInfo *models.ImageMeta) error
+	// Получаем неотправленные сообщения
+	GetOutbox(ctx context.Context, limit int) ([]models.OutboxMessage, error)
+	// Удаляем отправленное сообщение
+	DeleteOutbox(ctx context.Context, id int64) error
+	// Запоминаем неудачную попытку отправки
+	FailOutbox(ctx context.Context, id int64, sendErr string) error
+	// Обновляем статус задачи на генерацию миниатюры, отмененные задачи не меняются
+	UpdateThumbnailJob(ctx context.Context, jobID int, status string, jobErr string) error
+	// Берем задачу в работу, false - задача отменена, удалена или уже выполнена
+	StartThumbnailJob(ctx context.Context, jobID int) (bool, error)
+	// Получаем состояние задачи на миниатюру
+	GetThumbnailJob(ctx context.Context, owner models.Owner, id int) (*models.ThumbnailJob, error)
+	// Помечаем загрузку удаленной и отменяем ее невыполненные задачи
+	DeleteUpload(ctx context.Context, owner models.Owner, id int) error
+	// Восстанавливаем загрузку, удаленную не раньше чем window назад, и повторно ставим отмененные задачи
+	RestoreUpload(ctx context.Context, owner models.Owner, id int, window time.Duration, msgID func(jobID int) string) (int, error)
+	// Получаем загрузки, удаленные раньше чем window назад
+	GetExpiredUploads(ctx context.Context, window time.Duration, limit int) ([]models.ExpiredUpload, error)
+	// Окончательно удаляем загрузку вместе с миниатюрами и задачами
+	PurgeUpload(ctx context.Context, id int) error
+	// Откладываем очистку загрузки после ошибки: backoff, удваиваясь с каждой попыткой, но не больше maxBackoff
+	MarkPurgeFailed(ctx context.Context, id int, reason string, backoff time.Duration, maxBackoff time.Duration) error
+	// Посчитан ли уже перцептивный хэш оригинала
+	HasPerceptualHash(ctx context.Context, uploadID int) (bool, error)
+	// Сохраняем перцептивный хэш оригинала
+	SavePerceptualHash(ctx context.Context, uploadID int, hash uint64) error
+	// Ищем изображения, хэш которых отличается не больше чем на maxDistance бит
+	GetSimilar(ctx context.Context, owner models.Owner, id int, maxDistance int) ([]models.SimilarImage, error)
+	// Сохраняем недоставленную задачу
+	SaveDeadLetter(ctx context.Context, deadLetter *models.DeadLetter) error
+	// Получаем недоставленные задачи, пустой статус - все
+	GetDeadLetters(ctx context.Context, tenant string, status string) ([]models.DeadLetter, error)
+	// Получаем недоставленную задачу по id
+	GetDeadLetter(ctx context.Context, tenant string, id int) (*models.DeadLetter, error)
+	// Меняем статус недоставленной задачи, если он совпадает с ожидаемым
+	UpdateDeadLetterStatus(ctx context.Context, id int, from string, to string) error
 	// Получаем информацию о картинках
-	GetData(ctx context.Context) ([]models.AllImages, error)
+	GetData(ctx context.Context, owner models.Owner) ([]models.AllImages, error)
 	// Получаем информацию о картинках по id
-	GetDataId(ctx context.Context, id int) ([]models.AllImages, error)
+	GetDataId(ctx context.Context, owner models.Owner, id int) (*models.UploadInfo, error)
+	// Получаем страницу списка загрузок с миниатюрами
+	ListUploads(ctx context.Context, owner models.Owner, filter models.UploadFilter) (*models.UploadPage, error)
+	// Ставим событие в журнал доставки для всех подписанных на него вебхуков
+	EnqueueWebhookEvent(ctx context.Context, event *models.WebhookEvent) error
+	// Регистрируем вебхук
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+	// Получаем зарегистрированные вебхуки без ключей
+	GetWebhooks(ctx context.Context, owner models.Owner) ([]models.Webhook, error)
+	// Удаляем вебхук вместе с журналом доставки
+	DeleteWebhook(ctx context.Context, owner models.Owner, id int) error
+	// Получаем журнал доставки вебхука, пустой статус - все
+	GetWebhookDeliveries(ctx context.Context, owner models.Owner, webhookID int, status string, limit int) ([]models.WebhookDelivery, error)
+	// Забираем доставки, время попытки которых подошло, до следующей попытки не позже чем через lease
+	ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	// Отмечаем успешную доставку
+	MarkWebhookDelivered(ctx context.Context, id int64, statusCode int) error
+	// Запоминаем неудачную попытку доставки
+	FailWebhookDelivery(ctx context.Context, id int64, statusCode int, deliveryErr string, retryIn time.Duration, final bool) error
+	// Сохраняем API ключ, хранится только хэш
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	// Ищем действующий ключ по хэшу
+	GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error)
+	// Получаем ключи арендатора, включая отозванные, пустой арендатор - все
+	GetAPIKeys(ctx context.Context, tenant string) ([]models.APIKey, error)
+	// Отзываем ключ арендатора, пустой арендатор - любой
+	RevokeAPIKey(ctx context.Context, tenant string, id int) error
 }
 
 type storage struct {
 	conn *pgxpool.Pool
 }
 
-// Загрузка данных в БД об изначальных изображениях
-func (s *storage) SaveFileMeta(ctx context.Context, metaInfo *models.ImageMeta) error {
-	query := "INSERT INTO public.uploads_info (name, type, width, height) VALUES ($1, $2, $3, $4)"
-
+// Загрузка данных в БД об изначальном изображении вместе с задачами и сообщениями для Nats
+// Все пишется в одной транзакции, поэтому у сохраненной загрузки всегда есть задачи в очереди
+func (s *storage) SaveUpload(ctx context.Context, owner models.Owner, metaInfo *models.ImageMeta, force bool, quota models.Quota, presets []models.ThumbnailPreset, newMessage models.OutboxBuilder) (*models.SavedUpload, error) {
 	// 10 секунд на выполнение операции с этим контекстом
 	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
 
-	_, err := s.conn.Exec(ctxDb, query, metaInfo.Name, metaInfo.Type, metaInfo.Width, metaInfo.Height)
+	tx, err := s.conn.Begin(ctxDb)
 	if err != nil {
-		return errors.Wrap(err, "failed to write file meta to db")
+		return nil, errors.Wrap(err, "failed to begin transaction")
 	}
+	defer tx.Rollback(ctxDb)
 
-	return nil
+	// Параллельные загрузки арендатора проверяют лимит по очереди, иначе обе уложились бы в остаток
+	limited := quota.MaxBytes > 0 || quota.MaxImages > 0
+	if limited {
+		if _, err = tx.Exec(ctxDb, "SELECT pg_advisory_xact_lock($1, hashtext($2))", quotaLockClass, owner.TenantID); err != nil {
+			return nil, errors.Wrap(err, "failed to lock tenant quota")
+		}
+	}
+
+	// Принудительная копия ссылается на первую загрузку и не участвует в уникальном индексе
+	var duplicateOf *int
+	if force {
+		duplicateOf, err = getUploadIDBySHA256(ctxDb, tx, owner, metaInfo.SHA256)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var uploadID int
+	var uploadAt time.Time
+	query := `INSERT INTO public.uploads_info (tenant_id, owner_id, name, original_name, sha256, duplicate_of, type, width, height, size)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (tenant_id, owner_id, sha256) WHERE duplicate_of IS NULL AND deleted_at IS NULL DO NOTHING RETURNING id, upload_at`
+	err = tx.QueryRow(ctxDb, query, owner.TenantID, owner.OwnerID, metaInfo.Name, metaInfo.OriginalName, metaInfo.SHA256, duplicateOf,
+		metaInfo.Type, metaInfo.Width, metaInfo.Height, metaInfo.Size).Scan(&uploadID, &uploadAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Такое содержимое уже загружено, в том числе параллельным запросом
+		existingID, err := getUploadIDBySHA256(ctxDb, tx, owner, metaInfo.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		if existingID == nil {
+			return nil, errors.New("duplicate upload disappeared")
+		}
+		return &models.SavedUpload{ID: *existingID}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write file meta to db")
+	}
+
+	// Повтор содержимого места не занимает, поэтому лимит проверяем только для новой записи
+	if limited {
+		usage, err := getTenantUsage(ctxDb, tx, owner.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		if quota.Exceeded(*usage, 0, 0) {
+			return nil, models.ErrQuotaExceeded
+		}
+	}
+
+	saved := &models.SavedUpload{ID: uploadID, Created: true, Jobs: make([]models.UploadJob, 0, len(presets))}
+	for _, preset := range presets {
+		var jobID int
+		query = "INSERT INTO public.thumbnail_jobs (upload_id, preset, status) VALUES ($1, $2, $3) RETURNING id"
+		if err = tx.QueryRow(ctxDb, query, uploadID, preset.Name, models.JobStatusPending).Scan(&jobID); err != nil {
+			return nil, errors.Wrap(err, "failed to create thumbnail job")
+		}
+		saved.Jobs = append(saved.Jobs, models.UploadJob{ID: jobID, Preset: preset.Name})
+
+		msg, err := newMessage(uploadID, jobID, preset)
+		if err != nil {
+			return nil, err
+		}
+		// Сообщение нужно, чтобы поставить задачу повторно после восстановления
+		query = "UPDATE public.thumbnail_jobs SET subject = $2, payload = $3 WHERE id = $1"
+		if _, err = tx.Exec(ctxDb, query, jobID, msg.Subject, msg.Payload); err != nil {
+			return nil, errors.Wrap(err, "failed to save thumbnail job message")
+		}
+		query = "INSERT INTO public.outbox (subject, msg_id, payload) VALUES ($1, $2, $3)"
+		if _, err = tx.Exec(ctxDb, query, msg.Subject, msg.MsgID, msg.Payload); err != nil {
+			return nil, errors.Wrap(err, "failed to write outbox message")
+		}
+	}
+
+	err = enqueueWebhookEvent(ctxDb, tx, &models.WebhookEvent{
+		Event:    models.WebhookEventUploadCreated,
+		UploadID: uploadID,
+		Upload: &models.UploadInfo{
+			ID:           uint(uploadID),
+			Name:         metaInfo.Name,
+			OriginalName: metaInfo.OriginalName,
+			SHA256:       metaInfo.SHA256,
+			Type:         metaInfo.Type,
+			Width:        metaInfo.Width,
+			Height:       metaInfo.Height,
+			UploadAt:     uploadAt,
+			Thumbnails:   make([]models.Thumbnail, 0),
+		},
+		Time: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctxDb); err != nil {
+		return nil, errors.Wrap(err, "failed to commit upload")
+	}
+
+	return saved, nil
 }
 
-// Загрузка данных в БД о миниатюрах
-func (s *storage) SaveFileMiniMeta(ctx context.Context, metaInfo *models.ImageMeta) error {
-	query := "INSERT INTO public.mini_info (name, type, width, height) VALUES ($1, $2, $3, $4)"
+// Ищем первую загрузку владельца с тем же содержимым, nil - такой нет
+func getUploadIDBySHA256(ctx context.Context, tx pgx.Tx, owner models.Owner, sha256 string) (*int, error) {
+	query := "SELECT id FROM public.uploads_info WHERE tenant_id = $1 AND owner_id = $2 AND sha256 = $3 AND duplicate_of IS NULL AND deleted_at IS NULL"
 
+	var id int
+	if err := tx.QueryRow(ctx, query, owner.TenantID, owner.OwnerID, sha256).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to find upload by sha256")
+	}
+
+	return &id, nil
+}
+
+// Получаем занятое арендатором место
+func (s *storage) GetTenantUsage(ctx context.Context, tenant string) (*models.TenantUsage, error) {
 	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
 
-	_, err := s.conn.Exec(ctxDb, query, metaInfo.Name, metaInfo.Type, metaInfo.Width, metaInfo.Height)
+	return getTenantUsage(ctxDb, s.conn, tenant)
+}
+
+// Считаем оригиналы и миниатюры арендатора, удаленные загрузки занимают место до очистки
+func getTenantUsage(ctx context.Context, q rowQuerier, tenant string) (*models.TenantUsage, error) {
+	query := `SELECT
+			(SELECT count(*) FROM public.uploads_info WHERE tenant_id = $1),
+			((SELECT COALESCE(sum(size), 0) FROM public.uploads_info WHERE tenant_id = $1) +
+			(SELECT COALESCE(sum(size), 0) FROM public.mini_info WHERE tenant_id = $1))::bigint`
+
+	usage := &models.TenantUsage{TenantID: tenant}
+	if err := q.QueryRow(ctx, query, tenant).Scan(&usage.Images, &usage.Bytes); err != nil {
+		return nil, errors.Wrap(err, "failed to get tenant usage")
+	}
+
+	return usage, nil
+}
+
+// Загрузка данных в БД о миниатюрах, арендатор берется у оригинала
+// Повторная обработка того же пресета перезаписывает запись
+func (s *storage) SaveFileMiniMeta(ctx context.Context, uploadID int, preset string, metaInfo *models.ImageMeta) error {
+	query := `INSERT INTO public.mini_info (upload_id, tenant_id, preset, name, type, width, height, size)
+		VALUES ($1, (SELECT tenant_id FROM public.uploads_info WHERE id = $1), $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (upload_id, preset) DO UPDATE SET name = EXCLUDED.name, type = EXCLUDED.type, width = EXCLUDED.width, height = EXCLUDED.height,
+			size = EXCLUDED.size, upload_at = now()`
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	_, err := s.conn.Exec(ctxDb, query, uploadID, preset, metaInfo.Name, metaInfo.Type, metaInfo.Width, metaInfo.Height, metaInfo.Size)
 	if err != nil {
 		return errors.Wrap(err, "failed to write fileMini meta to db")
 	}
@@ -55,42 +262,298 @@ func (s *storage) SaveFileMiniMeta(ctx context.Context, metaInfo *models.ImageMe
 	return nil
 }
 
-// Получаем информацию о картинках
-func (s *storage) GetData(ctx context.Context) ([]models.AllImages, error) {
-	//query := "SELECT id, name, type, height, width FROM public.mini_info"
-
-	query := "SELECT ui.id, ui.name, ui.type, ui.width, ui.height, mi.name, mi.width, mi.height FROM public.mini_info mi INNER JOIN public.uploads_info ui ON mi.id = ui.id"
+// Получаем неотправленные сообщения, самые старые первыми
+func (s *storage) GetOutbox(ctx context.Context, limit int) ([]models.OutboxMessage, error) {
+	query := "SELECT id, subject, msg_id, payload FROM public.outbox ORDER BY id LIMIT $1"
 
-	rows, err := s.conn.Query(ctx, query)
+	rows, err := s.conn.Query(ctx, query, limit)
 	if err != nil {
+		return nil, errors.Wrap(err, "failed to get outbox")
+	}
+	defer rows.Close()
+
+	var messages = make([]models.OutboxMessage, 0)
+
+	for rows.Next() {
+		var msg models.OutboxMessage
+		if err = rows.Scan(&msg.ID, &msg.Subject, &msg.MsgID, &msg.Payload); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
 		return nil, err
 	}
+
+	return messages, nil
+}
+
+// Удаляем отправленное сообщение
+func (s *storage) DeleteOutbox(ctx context.Context, id int64) error {
+	query := "DELETE FROM public.outbox WHERE id = $1"
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	if _, err := s.conn.Exec(ctxDb, query, id); err != nil {
+		return errors.Wrap(err, "failed to delete outbox message")
+	}
+
+	return nil
+}
+
+// Запоминаем неудачную попытку отправки
+func (s *storage) FailOutbox(ctx context.Context, id int64, sendErr string) error {
+	query := "UPDATE public.outbox SET attempts = attempts + 1, last_error = $2 WHERE id = $1"
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	if _, err := s.conn.Exec(ctxDb, query, id, sendErr); err != nil {
+		return errors.Wrap(err, "failed to update outbox message")
+	}
+
+	return nil
+}
+
+// Обновляем статус задачи на генерацию миниатюры
+func (s *storage) UpdateThumbnailJob(ctx context.Context, jobID int, status string, jobErr string) error {
+	// Время завершения только у выполненных и неудачных задач
+	query := `UPDATE public.thumbnail_jobs SET status = $2, error = NULLIF($3, ''), updated_at = now(),
+		finished_at = CASE WHEN $2 IN ($5, $6) THEN now() END
+		WHERE id = $1 AND status <> $4`
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	if _, err := s.conn.Exec(ctxDb, query, jobID, status, jobErr, models.JobStatusCancelled, models.JobStatusDone, models.JobStatusFailed); err != nil {
+		return errors.Wrap(err, "failed to update thumbnail job")
+	}
+
+	return nil
+}
+
+// Берем задачу в работу, false - задача отменена, удалена или уже выполнена
+// Каждый вызов - новая попытка, ошибка предыдущей сохраняется до ее завершения
+// Выполненную задачу повторная доставка не трогает: иначе миниатюра пересоздалась бы, а прежний файл остался бы в хранилище
+func (s *storage) StartThumbnailJob(ctx context.Context, jobID int) (bool, error) {
+	query := `UPDATE public.thumbnail_jobs SET status = $2, attempts = attempts + 1, started_at = now(), finished_at = NULL, updated_at = now()
+		WHERE id = $1 AND status NOT IN ($3, $4)`
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	tag, err := s.conn.Exec(ctxDb, query, jobID, models.JobStatusProcessing, models.JobStatusCancelled, models.JobStatusDone)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to start thumbnail job")
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// Получаем состояние задачи на миниатюру загрузки владельца
+func (s *storage) GetThumbnailJob(ctx context.Context, owner models.Owner, id int) (*models.ThumbnailJob, error) {
+	query := `SELECT tj.id, tj.upload_id, tj.preset, tj.status, tj.attempts, COALESCE(tj.error, ''), tj.created_at, tj.updated_at, tj.started_at, tj.finished_at
+		FROM public.thumbnail_jobs tj INNER JOIN public.uploads_info ui ON ui.id = tj.upload_id WHERE tj.id = $1 AND ui.tenant_id = $2 AND ui.owner_id = $3`
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	var job models.ThumbnailJob
+	err := s.conn.QueryRow(ctxDb, query, id, owner.TenantID, owner.OwnerID).Scan(&job.ID, &job.UploadID, &job.Preset, &job.Status, &job.Attempts, &job.Error,
+		&job.CreatedAt, &job.UpdatedAt, &job.StartedAt, &job.FinishedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to get thumbnail job")
+	}
+
+	return &job, nil
+}
+
+// Сохраняем недоставленную задачу
+// Повторная доставка того же сообщения из очереди запись не дублирует
+func (s *storage) SaveDeadLetter(ctx context.Context, deadLetter *models.DeadLetter) error {
+	query := `INSERT INTO public.dead_letters (stream_seq, job_id, upload_id, subject, payload, error, attempts)
+		VALUES ($1, (SELECT id FROM public.thumbnail_jobs WHERE id = $2), (SELECT id FROM public.uploads_info WHERE id = $3), $4, $5, $6, $7)
+		ON CONFLICT (stream_seq) DO NOTHING`
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	_, err := s.conn.Exec(ctxDb, query, deadLetter.StreamSeq, deadLetter.JobID, deadLetter.UploadID,
+		deadLetter.Subject, []byte(deadLetter.Payload), deadLetter.Error, deadLetter.Attempts)
+	if err != nil {
+		return errors.Wrap(err, "failed to save dead letter")
+	}
+
+	return nil
+}
+
+// Получаем недоставленные задачи, пустой статус - все
+func (s *storage) GetDeadLetters(ctx context.Context, tenant string, status string) ([]models.DeadLetter, error) {
+	query := `SELECT id, stream_seq, COALESCE(job_id, 0), COALESCE(upload_id, 0), subject, payload, error, attempts, status, created_at, updated_at
+		FROM public.dead_letters WHERE ($1 = '' OR status = $1) AND ($2 = '' OR subject = $3) ORDER BY id DESC`
+
+	rows, err := s.conn.Query(ctx, query, status, tenant, models.PictureSubject(tenant))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get dead letters")
+	}
 	defer rows.Close()
 
-	var images = make([]models.AllImages, 0)
+	var deadLetters = make([]models.DeadLetter, 0)
 
 	for rows.Next() {
-		var image models.AllImages
-		if err = rows.Scan(&image.ID, &image.Name, &image.Type, &image.Width, &image.Height, &image.NameMini, &image.WidthMini, &image.HeightMini); err != nil {
+		deadLetter, err := scanDeadLetter(rows)
+		if err != nil {
 			return nil, err
 		}
-		images = append(images, image)
+		deadLetters = append(deadLetters, *deadLetter)
 	}
 
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
+
+// Получаем недоставленную задачу по id, задача другого арендатора - ErrNotFound
+func (s *storage) GetDeadLetter(ctx context.Context, tenant string, id int) (*models.DeadLetter, error) {
+	query := `SELECT id, stream_seq, COALESCE(job_id, 0), COALESCE(upload_id, 0), subject, payload, error, attempts, status, created_at, updated_at
+		FROM public.dead_letters WHERE id = $1 AND ($2 = '' OR subject = $3)`
+
+	deadLetter, err := scanDeadLetter(s.conn.QueryRow(ctx, query, id, tenant, models.PictureSubject(tenant)))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to get dead letter")
+	}
+
+	return deadLetter, nil
+}
+
+// Меняем статус недоставленной задачи, если он совпадает с ожидаемым
+func (s *storage) UpdateDeadLetterStatus(ctx context.Context, id int, from string, to string) error {
+	query := "UPDATE public.dead_letters SET status = $3, updated_at = now() WHERE id = $1 AND status = $2"
+
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	tag, err := s.conn.Exec(ctxDb, query, id, from, to)
+	if err != nil {
+		return errors.Wrap(err, "failed to update dead letter status")
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrConflict
+	}
+
+	return nil
+}
+
+// Читаем недоставленную задачу из строки результата
+func scanDeadLetter(row pgx.Row) (*models.DeadLetter, error) {
+	var deadLetter models.DeadLetter
+	var payload []byte
+	err := row.Scan(&deadLetter.ID, &deadLetter.StreamSeq, &deadLetter.JobID, &deadLetter.UploadID, &deadLetter.Subject,
+		&payload, &deadLetter.Error, &deadLetter.Attempts, &deadLetter.Status, &deadLetter.CreatedAt, &deadLetter.UpdatedAt)
+	if err != nil {
 		return nil, err
 	}
+	deadLetter.Payload = string(payload)
+
+	return &deadLetter, nil
+}
+
+// Посчитан ли уже перцептивный хэш оригинала
+// Удаленную загрузку считаем обработанной, хэш ей не нужен
+func (s *storage) HasPerceptualHash(ctx context.Context, uploadID int) (bool, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	var has bool
+	query := "SELECT phash IS NOT NULL FROM public.uploads_info WHERE id = $1"
+	err := s.conn.QueryRow(ctxDb, query, uploadID).Scan(&has)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check perceptual hash")
+	}
+
+	return has, nil
+}
+
+// Сохраняем перцептивный хэш оригинала, уже сохраненный хэш не перезаписываем
+// Хэш хранится в bigint, uint64 переводим в int64 без изменения битов
+func (s *storage) SavePerceptualHash(ctx context.Context, uploadID int, hash uint64) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := "UPDATE public.uploads_info SET phash = $2 WHERE id = $1 AND phash IS NULL"
+	if _, err := s.conn.Exec(ctxDb, query, uploadID, int64(hash)); err != nil {
+		return errors.Wrap(err, "failed to save perceptual hash")
+	}
+
+	return nil
+}
+
+// Ищем изображения владельца, хэш которых отличается не больше чем на maxDistance бит
+// Расстояние Хэмминга - число единиц в XOR хэшей
+func (s *storage) GetSimilar(ctx context.Context, owner models.Owner, id int, maxDistance int) ([]models.SimilarImage, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	var phash *int64
+	query := "SELECT phash FROM public.uploads_info WHERE id = $1 AND tenant_id = $2 AND owner_id = $3 AND deleted_at IS NULL"
+	err := s.conn.QueryRow(ctxDb, query, id, owner.TenantID, owner.OwnerID).Scan(&phash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to get perceptual hash")
+	}
+	// Хэш еще не посчитан воркером
+	if phash == nil {
+		return nil, models.ErrConflict
+	}
+
+	query = `SELECT id, name, COALESCE(original_name, name), type, width, height, distance FROM (
+			SELECT *, length(replace(((phash # $2)::bit(64))::text, '0', '')) AS distance
+			FROM public.uploads_info WHERE id <> $1 AND tenant_id = $4 AND owner_id = $5 AND phash IS NOT NULL AND deleted_at IS NULL
+		) ui WHERE distance <= $3 ORDER BY distance, id`
+
+	rows, err := s.conn.Query(ctxDb, query, id, *phash, maxDistance, owner.TenantID, owner.OwnerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get similar images")
+	}
+	defer rows.Close()
+
+	var images = make([]models.SimilarImage, 0)
+	for rows.Next() {
+		var image models.SimilarImage
+		if err = rows.Scan(&image.ID, &image.Name, &image.OriginalName, &image.Type, &image.Width, &image.Height, &image.Distance); err != nil {
+			return nil, errors.Wrap(err, "failed to scan similar image")
+		}
+		images = append(images, image)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read similar images")
+	}
 
 	return images, nil
 }
 
-// Получаем информацию о картинках по id
-func (s *storage) GetDataId(ctx context.Context, id int) ([]models.AllImages, error) {
+// Получаем информацию о картинках владельца
+func (s *storage) GetData(ctx context.Context, owner models.Owner) ([]models.AllImages, error) {
 	//query := "SELECT id, name, type, height, width FROM public.mini_info"
 
-	query := "SELECT ui.id, ui.name, ui.type, ui.width, ui.height, mi.name, mi.width, mi.height FROM public.mini_info mi INNER JOIN public.uploads_info ui ON mi.id = ui.id WHERE ui.id = $1"
+	query := "SELECT ui.id, ui.name, ui.type, ui.width, ui.height, mi.preset, mi.name, mi.width, mi.height FROM public.mini_info mi INNER JOIN public.uploads_info ui ON mi.upload_id = ui.id WHERE ui.tenant_id = $1 AND ui.owner_id = $2 AND ui.deleted_at IS NULL"
 
-	rows, err := s.conn.Query(ctx, query, id)
+	rows, err := s.conn.Query(ctx, query, owner.TenantID, owner.OwnerID)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +563,7 @@ func (s *storage) GetDataId(ctx context.Context, id int) ([]models.AllImages, er
 
 	for rows.Next() {
 		var image models.AllImages
-		if err = rows.Scan(&image.ID, &image.Name, &image.Type, &image.Width, &image.Height, &image.NameMini, &image.WidthMini, &image.HeightMini); err != nil {
+		if err = rows.Scan(&image.ID, &image.Name, &image.Type, &image.Width, &image.Height, &image.Preset, &image.NameMini, &image.WidthMini, &image.HeightMini); err != nil {
 			return nil, err
 		}
 		images = append(images, image)
@@ -113,6 +576,55 @@ func (s *storage) GetDataId(ctx context.Context, id int) ([]models.AllImages, er
 	return images, nil
 }
 
+// Получаем информацию о картинке владельца по id вместе со всеми миниатюрами
+func (s *storage) GetDataId(ctx context.Context, owner models.Owner, id int) (*models.UploadInfo, error) {
+	query := "SELECT id, name, COALESCE(original_name, name), COALESCE(sha256, ''), type, width, height, upload_at FROM public.uploads_info WHERE id = $1 AND tenant_id = $2 AND owner_id = $3 AND deleted_at IS NULL"
+
+	var upload models.UploadInfo
+	err := s.conn.QueryRow(ctx, query, id, owner.TenantID, owner.OwnerID).Scan(&upload.ID, &upload.Name, &upload.OriginalName, &upload.SHA256, &upload.Type, &upload.Width, &upload.Height, &upload.UploadAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, errors.Wrap(err, "failed to get upload")
+	}
+
+	thumbnails, err := s.getThumbnails(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	upload.Thumbnails = thumbnails
+
+	return &upload, nil
+}
+
+// Получаем все миниатюры оригинала
+func (s *storage) getThumbnails(ctx context.Context, uploadID int) ([]models.Thumbnail, error) {
+	query := "SELECT preset, name, type, width, height FROM public.mini_info WHERE upload_id = $1 ORDER BY width"
+
+	rows, err := s.conn.Query(ctx, query, uploadID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get thumbnails")
+	}
+	defer rows.Close()
+
+	var thumbnails = make([]models.Thumbnail, 0)
+
+	for rows.Next() {
+		var thumbnail models.Thumbnail
+		if err = rows.Scan(&thumbnail.Preset, &thumbnail.Name, &thumbnail.Type, &thumbnail.Width, &thumbnail.Height); err != nil {
+			return nil, err
+		}
+		thumbnails = append(thumbnails, thumbnail)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return thumbnails, nil
+}
+
 func New(conn *pgxpool.Pool) Storage {
 	return &storage{
 		conn: conn,
@@ -0,0 +1,417 @@
+package postgres
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pkg/errors"
+)
+
+// Код ошибки Postgres при нарушении уникальности
+const uniqueViolation = "23505"
+
+// Первый ключ pg_advisory_xact_lock для блокировки лимитов арендатора
+const quotaLockClass = 1
+
+// Выражение для сортировки и тип, к которому приводится значение из курсора
+// Выражения совпадают с индексами из миграции 0014
+type sortColumn struct {
+	expr string
+	cast string
+}
+
+var sortColumns = map[string]sortColumn{
+	models.SortUploadAt: {expr: "ui.upload_at", cast: "timestamp"},
+	models.SortID:       {expr: "ui.id", cast: "int"},
+	models.SortName:     {expr: "COALESCE(ui.original_name, '')", cast: "text"},
+	models.SortWidth:    {expr: "COALESCE(ui.width, 0)", cast: "int"},
+	models.SortHeight:   {expr: "COALESCE(ui.height, 0)", cast: "int"},
+}
+
+// Позиция в списке: значение поля сортировки последней записи и ее id
+type uploadCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func encodeCursor(cursor uploadCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(value string, sort string) (*uploadCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, models.ErrInvalidCursor
+	}
+
+	var cursor uploadCursor
+	if err = json.Unmarshal(b, &cursor); err != nil || cursor.Sort != sort {
+		return nil, models.ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// Условия WHERE с нумерованными параметрами
+type whereBuilder struct {
+	conds []string
+	args  []any
+}
+
+func (w *whereBuilder) arg(value any) string {
+	w.args = append(w.args, value)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+func (w *whereBuilder) add(cond string) {
+	w.conds = append(w.conds, cond)
+}
+
+func (w *whereBuilder) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
+
+// Экранируем спецсимволы LIKE, чтобы префикс искался буквально
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Получаем страницу списка загрузок владельца с миниатюрами
+// Пагинация по ключу (значение сортировки, id), поэтому вставки не сдвигают страницы
+func (s *storage) ListUploads(ctx context.Context, owner models.Owner, filter models.UploadFilter) (*models.UploadPage, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	if filter.Sort == "" {
+		filter.Sort = models.SortUploadAt
+	}
+	column, ok := sortColumns[filter.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort field %q", filter.Sort)
+	}
+
+	var where whereBuilder
+	where.add("ui.tenant_id = " + where.arg(owner.TenantID))
+	where.add("ui.owner_id = " + where.arg(owner.OwnerID))
+	where.add("ui.deleted_at IS NULL")
+	if filter.Type != "" {
+		where.add("ui.type = " + where.arg(filter.Type))
+	}
+	if filter.NamePrefix != "" {
+		where.add("COALESCE(ui.original_name, '') LIKE " + where.arg(escapeLike(filter.NamePrefix)+"%"))
+	}
+	if filter.MinWidth > 0 {
+		where.add("COALESCE(ui.width, 0) >= " + where.arg(filter.MinWidth))
+	}
+	if filter.MaxWidth > 0 {
+		where.add("COALESCE(ui.width, 0) <= " + where.arg(filter.MaxWidth))
+	}
+	if filter.MinHeight > 0 {
+		where.add("COALESCE(ui.height, 0) >= " + where.arg(filter.MinHeight))
+	}
+	if filter.MaxHeight > 0 {
+		where.add("COALESCE(ui.height, 0) <= " + where.arg(filter.MaxHeight))
+	}
+	if !filter.From.IsZero() {
+		where.add("ui.upload_at >= " + where.arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where.add("ui.upload_at < " + where.arg(filter.To))
+	}
+
+	// Общее число считаем по фильтрам без учета позиции
+	var page models.UploadPage
+	query := "SELECT count(*) FROM public.uploads_info ui" + where.String()
+	if err := s.conn.QueryRow(ctxDb, query, where.args...).Scan(&page.Total); err != nil {
+		return nil, errors.Wrap(err, "failed to count uploads")
+	}
+
+	order, cmp := "ASC", ">"
+	if filter.Desc {
+		order, cmp = "DESC", "<"
+	}
+	if filter.Cursor != "" {
+		cursor, err := decodeCursor(filter.Cursor, filter.Sort)
+		if err != nil {
+			return nil, err
+		}
+		where.add(fmt.Sprintf("(%s, ui.id) %s (%s::%s, %s)", column.expr, cmp, where.arg(cursor.Value), column.cast, where.arg(cursor.ID)))
+	}
+
+	// Запрашиваем на одну запись больше, чтобы узнать, есть ли следующая страница
+	query = fmt.Sprintf(`SELECT ui.id, ui.name, COALESCE(ui.original_name, ui.name), COALESCE(ui.sha256, ''), ui.type, ui.width, ui.height, ui.upload_at, (%s)::text
+		FROM public.uploads_info ui%s ORDER BY %s %s, ui.id %s LIMIT %d`, column.expr, where.String(), column.expr, order, order, filter.Limit+1)
+
+	rows, err := s.conn.Query(ctxDb, query, where.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list uploads")
+	}
+	defer rows.Close()
+
+	page.Items = make([]models.UploadInfo, 0, filter.Limit)
+	ids := make([]int, 0, filter.Limit)
+	var lastKey string
+	for rows.Next() {
+		if len(page.Items) == filter.Limit {
+			last := page.Items[len(page.Items)-1]
+			page.NextCursor = encodeCursor(uploadCursor{Sort: filter.Sort, Value: lastKey, ID: int(last.ID)})
+			break
+		}
+
+		var upload models.UploadInfo
+		if err = rows.Scan(&upload.ID, &upload.Name, &upload.OriginalName, &upload.SHA256, &upload.Type, &upload.Width, &upload.Height, &upload.UploadAt, &lastKey); err != nil {
+			return nil, errors.Wrap(err, "failed to scan upload")
+		}
+		upload.Thumbnails = make([]models.Thumbnail, 0)
+		page.Items = append(page.Items, upload)
+		ids = append(ids, int(upload.ID))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read uploads")
+	}
+	rows.Close()
+
+	if err = s.fillThumbnails(ctxDb, page.Items, ids); err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+// Загружаем миниатюры для всех записей страницы одним запросом
+func (s *storage) fillThumbnails(ctx context.Context, uploads []models.UploadInfo, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	index := make(map[int]int, len(uploads))
+	for i := range uploads {
+		index[int(uploads[i].ID)] = i
+	}
+
+	query := "SELECT upload_id, preset, name, type, width, height FROM public.mini_info WHERE upload_id = ANY($1) ORDER BY upload_id, width"
+	rows, err := s.conn.Query(ctx, query, ids)
+	if err != nil {
+		return errors.Wrap(err, "failed to get thumbnails")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uploadID int
+		var thumbnail models.Thumbnail
+		if err = rows.Scan(&uploadID, &thumbnail.Preset, &thumbnail.Name, &thumbnail.Type, &thumbnail.Width, &thumbnail.Height); err != nil {
+			return errors.Wrap(err, "failed to scan thumbnail")
+		}
+		if i, ok := index[uploadID]; ok {
+			uploads[i].Thumbnails = append(uploads[i].Thumbnails, thumbnail)
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "failed to read thumbnails")
+}
+
+// Помечаем загрузку удаленной и отменяем ее невыполненные задачи
+// Уже отправленные в Nats задачи воркер пропустит, увидев статус cancelled
+func (s *storage) DeleteUpload(ctx context.Context, owner models.Owner, id int) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	tx, err := s.conn.Begin(ctxDb)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctxDb)
+
+	query := "UPDATE public.uploads_info SET deleted_at = now() WHERE id = $1 AND tenant_id = $2 AND owner_id = $3 AND deleted_at IS NULL"
+	tag, err := tx.Exec(ctxDb, query, id, owner.TenantID, owner.OwnerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete upload")
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+
+	query = "UPDATE public.thumbnail_jobs SET status = $2, updated_at = now() WHERE upload_id = $1 AND status IN ($3, $4)"
+	if _, err = tx.Exec(ctxDb, query, id, models.JobStatusCancelled, models.JobStatusPending, models.JobStatusProcessing); err != nil {
+		return errors.Wrap(err, "failed to cancel thumbnail jobs")
+	}
+
+	err = enqueueWebhookEvent(ctxDb, tx, &models.WebhookEvent{Event: models.WebhookEventUploadDeleted, UploadID: id, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctxDb); err != nil {
+		return errors.Wrap(err, "failed to commit upload deletion")
+	}
+
+	return nil
+}
+
+// Восстанавливаем загрузку, удаленную не раньше чем window назад, и повторно ставим отмененные задачи
+// Возвращаем число задач, записанных в outbox
+func (s *storage) RestoreUpload(ctx context.Context, owner models.Owner, id int, window time.Duration, msgID func(jobID int) string) (int, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	tx, err := s.conn.Begin(ctxDb)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctxDb)
+
+	query := `UPDATE public.uploads_info SET deleted_at = NULL
+		WHERE id = $1 AND tenant_id = $3 AND owner_id = $4 AND deleted_at IS NOT NULL AND deleted_at > now() - make_interval(secs => $2)`
+	tag, err := tx.Exec(ctxDb, query, id, window.Seconds(), owner.TenantID, owner.OwnerID)
+	if err != nil {
+		// Пока загрузка была удалена, то же содержимое загрузили снова
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return 0, models.ErrConflict
+		}
+		return 0, errors.Wrap(err, "failed to restore upload")
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, models.ErrNotFound
+	}
+
+	query = `UPDATE public.thumbnail_jobs SET status = $2, error = NULL, updated_at = now()
+		WHERE upload_id = $1 AND status = $3 AND payload IS NOT NULL RETURNING id, subject, payload`
+	rows, err := tx.Query(ctxDb, query, id, models.JobStatusPending, models.JobStatusCancelled)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to requeue thumbnail jobs")
+	}
+	var messages []models.OutboxMessage
+	for rows.Next() {
+		var jobID int
+		var msg models.OutboxMessage
+		if err = rows.Scan(&jobID, &msg.Subject, &msg.Payload); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "failed to scan thumbnail job")
+		}
+		msg.MsgID = msgID(jobID)
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to read thumbnail jobs")
+	}
+
+	for _, msg := range messages {
+		query = "INSERT INTO public.outbox (subject, msg_id, payload) VALUES ($1, $2, $3)"
+		if _, err = tx.Exec(ctxDb, query, msg.Subject, msg.MsgID, msg.Payload); err != nil {
+			return 0, errors.Wrap(err, "failed to write outbox message")
+		}
+	}
+
+	if err = tx.Commit(ctxDb); err != nil {
+		return 0, errors.Wrap(err, "failed to commit upload restore")
+	}
+
+	return len(messages), nil
+}
+
+// Получаем загрузки, удаленные раньше чем window назад, вместе с именами файлов
+func (s *storage) GetExpiredUploads(ctx context.Context, window time.Duration, limit int) ([]models.ExpiredUpload, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := `SELECT ui.id, ui.name, COALESCE(array_agg(mi.name) FILTER (WHERE mi.name IS NOT NULL), '{}')
+		FROM public.uploads_info ui LEFT JOIN public.mini_info mi ON mi.upload_id = ui.id
+		WHERE ui.deleted_at <= now() - make_interval(secs => $1) AND (ui.purge_after IS NULL OR ui.purge_after <= now())
+		GROUP BY ui.id ORDER BY ui.purge_attempts, ui.id LIMIT $2`
+
+	rows, err := s.conn.Query(ctxDb, query, window.Seconds(), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get expired uploads")
+	}
+	defer rows.Close()
+
+	var uploads = make([]models.ExpiredUpload, 0)
+	for rows.Next() {
+		var upload models.ExpiredUpload
+		var name *string
+		var thumbnails []string
+		if err = rows.Scan(&upload.ID, &name, &thumbnails); err != nil {
+			return nil, errors.Wrap(err, "failed to scan expired upload")
+		}
+		if name != nil {
+			upload.Files = append(upload.Files, *name)
+		}
+		upload.Files = append(upload.Files, thumbnails...)
+		uploads = append(uploads, upload)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read expired uploads")
+	}
+
+	return uploads, nil
+}
+
+// Окончательно удаляем загрузку, миниатюры, задачи и недоставленные сообщения удаляются каскадом
+// Принудительные копии перевешиваем на другую загрузку с тем же содержимым,
+// иначе после обнуления duplicate_of они нарушат уникальность sha256
+func (s *storage) PurgeUpload(ctx context.Context, id int) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	tx, err := s.conn.Begin(ctxDb)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback(ctxDb)
+
+	// Основной становится уже загруженная заново копия, иначе самая ранняя из принудительных
+	var primaryID *int
+	query := `SELECT COALESCE(
+			(SELECT p.id FROM public.uploads_info p, public.uploads_info ui
+				WHERE ui.id = $1 AND p.tenant_id = ui.tenant_id AND p.owner_id = ui.owner_id AND p.sha256 = ui.sha256 AND p.id <> ui.id AND p.duplicate_of IS NULL AND p.deleted_at IS NULL),
+			(SELECT min(id) FROM public.uploads_info WHERE duplicate_of = $1))`
+	if err = tx.QueryRow(ctxDb, query, id).Scan(&primaryID); err != nil {
+		return errors.Wrap(err, "failed to find primary duplicate")
+	}
+	if primaryID != nil {
+		query = "UPDATE public.uploads_info SET duplicate_of = NULLIF($2, id) WHERE id = $2 OR duplicate_of = $1"
+		if _, err = tx.Exec(ctxDb, query, id, *primaryID); err != nil {
+			return errors.Wrap(err, "failed to reassign duplicates")
+		}
+	}
+
+	query = "DELETE FROM public.uploads_info WHERE id = $1 AND deleted_at IS NOT NULL"
+	if _, err = tx.Exec(ctxDb, query, id); err != nil {
+		return errors.Wrap(err, "failed to purge upload")
+	}
+
+	if err = tx.Commit(ctxDb); err != nil {
+		return errors.Wrap(err, "failed to commit upload purge")
+	}
+
+	return nil
+}
+
+// Откладываем очистку загрузки после ошибки: backoff, удваиваясь с каждой попыткой, но не больше maxBackoff
+func (s *storage) MarkPurgeFailed(ctx context.Context, id int, reason string, backoff time.Duration, maxBackoff time.Duration) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := `UPDATE public.uploads_info SET purge_attempts = purge_attempts + 1, purge_error = $2,
+		purge_after = now() + make_interval(secs => least($3 * power(2, purge_attempts), $4))
+		WHERE id = $1`
+	if _, err := s.conn.Exec(ctxDb, query, id, reason, backoff.Seconds(), maxBackoff.Seconds()); err != nil {
+		return errors.Wrap(err, "failed to mark purge failure")
+	}
+
+	return nil
+}
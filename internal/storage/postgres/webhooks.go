@@ -0,0 +1,230 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pkg/errors"
+)
+
+// Выполнение запроса в пуле или в транзакции
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// Запрос одной строки в пуле или в транзакции
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Ставим событие в журнал доставки для всех подписанных на него вебхуков владельца загрузки
+// Вызывается в той же транзакции, что и изменение, о котором событие
+func enqueueWebhookEvent(ctx context.Context, q execer, event *models.WebhookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal webhook event")
+	}
+
+	query := `INSERT INTO public.webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $1::text, $2 FROM public.webhooks
+		WHERE active AND (tenant_id, owner_id) = (SELECT tenant_id, owner_id FROM public.uploads_info WHERE id = $3) AND (cardinality(events) = 0 OR $1::text = ANY(events))`
+	if _, err = q.Exec(ctx, query, event.Event, payload, event.UploadID); err != nil {
+		return errors.Wrap(err, "failed to enqueue webhook event")
+	}
+
+	return nil
+}
+
+// Ставим событие в журнал доставки для всех подписанных на него вебхуков
+func (s *storage) EnqueueWebhookEvent(ctx context.Context, event *models.WebhookEvent) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	return enqueueWebhookEvent(ctxDb, s.conn, event)
+}
+
+// Регистрируем вебхук
+func (s *storage) CreateWebhook(ctx context.Context, webhook *models.Webhook) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := "INSERT INTO public.webhooks (tenant_id, owner_id, url, secret, events) VALUES ($1, $2, $3, $4, $5) RETURNING id, active, created_at"
+	err := s.conn.QueryRow(ctxDb, query, webhook.TenantID, webhook.OwnerID, webhook.URL, webhook.Secret, webhook.Events).Scan(&webhook.ID, &webhook.Active, &webhook.CreatedAt)
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook")
+	}
+
+	return nil
+}
+
+// Получаем вебхуки владельца без ключей
+func (s *storage) GetWebhooks(ctx context.Context, owner models.Owner) ([]models.Webhook, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := "SELECT id, tenant_id, owner_id, url, events, active, created_at FROM public.webhooks WHERE tenant_id = $1 AND owner_id = $2 ORDER BY id"
+	rows, err := s.conn.Query(ctxDb, query, owner.TenantID, owner.OwnerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get webhooks")
+	}
+	defer rows.Close()
+
+	var webhooks = make([]models.Webhook, 0)
+	for rows.Next() {
+		var webhook models.Webhook
+		if err = rows.Scan(&webhook.ID, &webhook.TenantID, &webhook.OwnerID, &webhook.URL, &webhook.Events, &webhook.Active, &webhook.CreatedAt); err != nil {
+			return nil, errors.Wrap(err, "failed to scan webhook")
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read webhooks")
+	}
+
+	return webhooks, nil
+}
+
+// Удаляем вебхук владельца вместе с журналом доставки
+func (s *storage) DeleteWebhook(ctx context.Context, owner models.Owner, id int) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	tag, err := s.conn.Exec(ctxDb, "DELETE FROM public.webhooks WHERE id = $1 AND tenant_id = $2 AND owner_id = $3", id, owner.TenantID, owner.OwnerID)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete webhook")
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
+
+// Получаем журнал доставки вебхука, новые записи первыми, пустой статус - все
+func (s *storage) GetWebhookDeliveries(ctx context.Context, owner models.Owner, webhookID int, status string, limit int) ([]models.WebhookDelivery, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	var exists bool
+	query := "SELECT EXISTS(SELECT 1 FROM public.webhooks WHERE id = $1 AND tenant_id = $2 AND owner_id = $3)"
+	if err := s.conn.QueryRow(ctxDb, query, webhookID, owner.TenantID, owner.OwnerID).Scan(&exists); err != nil {
+		return nil, errors.Wrap(err, "failed to get webhook")
+	}
+	if !exists {
+		return nil, models.ErrNotFound
+	}
+
+	query = `SELECT id, webhook_id, event, payload, status, attempts, last_status_code, COALESCE(last_error, ''), next_attempt_at, created_at, delivered_at
+		FROM public.webhook_deliveries WHERE webhook_id = $1 AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT $3`
+	rows, err := s.conn.Query(ctxDb, query, webhookID, status, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get webhook deliveries")
+	}
+	defer rows.Close()
+
+	var deliveries = make([]models.WebhookDelivery, 0)
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read webhook deliveries")
+	}
+
+	return deliveries, nil
+}
+
+// Забираем доставки, время попытки которых подошло, вместе с адресом и ключом
+// Следующая попытка сдвигается на lease, поэтому другой экземпляр или следующий тик их не получит,
+// а если отправитель упадет, доставки вернутся после lease
+func (s *storage) ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := `WITH due AS (
+			SELECT d.id FROM public.webhook_deliveries d INNER JOIN public.webhooks w ON w.id = d.webhook_id
+			WHERE d.status = $1 AND d.next_attempt_at <= now() AND w.active
+			ORDER BY d.next_attempt_at, d.id LIMIT $2 FOR UPDATE OF d SKIP LOCKED
+		)
+		UPDATE public.webhook_deliveries d SET next_attempt_at = now() + make_interval(secs => $3), updated_at = now()
+		FROM due, public.webhooks w WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.last_status_code, COALESCE(d.last_error, ''), d.next_attempt_at, d.created_at, d.delivered_at, w.url, w.secret`
+	rows, err := s.conn.Query(ctxDb, query, models.WebhookDeliveryPending, limit, lease.Seconds())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to claim due webhook deliveries")
+	}
+	defer rows.Close()
+
+	var deliveries = make([]models.WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		var payload []byte
+		err = rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts, &delivery.LastStatusCode,
+			&delivery.LastError, &delivery.NextAttemptAt, &delivery.CreatedAt, &delivery.DeliveredAt, &delivery.URL, &delivery.Secret)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan webhook delivery")
+		}
+		delivery.Payload = payload
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read webhook deliveries")
+	}
+
+	return deliveries, nil
+}
+
+// Отмечаем успешную доставку
+func (s *storage) MarkWebhookDelivered(ctx context.Context, id int64, statusCode int) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	query := `UPDATE public.webhook_deliveries SET status = $2, attempts = attempts + 1, last_status_code = $3, last_error = NULL,
+		delivered_at = now(), updated_at = now() WHERE id = $1`
+	if _, err := s.conn.Exec(ctxDb, query, id, models.WebhookDeliveryDelivered, statusCode); err != nil {
+		return errors.Wrap(err, "failed to mark webhook delivered")
+	}
+
+	return nil
+}
+
+// Запоминаем неудачную попытку: следующая через retryIn, final - попытки исчерпаны
+// statusCode 0 - ответа не было
+func (s *storage) FailWebhookDelivery(ctx context.Context, id int64, statusCode int, deliveryErr string, retryIn time.Duration, final bool) error {
+	ctxDb, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	status := models.WebhookDeliveryPending
+	if final {
+		status = models.WebhookDeliveryFailed
+	}
+
+	// Время считаем в БД, как и now() при выборке доставок
+	query := `UPDATE public.webhook_deliveries SET status = $2, attempts = attempts + 1, last_status_code = NULLIF($3, 0), last_error = $4,
+		next_attempt_at = now() + make_interval(secs => $5), updated_at = now() WHERE id = $1`
+	if _, err := s.conn.Exec(ctxDb, query, id, status, statusCode, deliveryErr, retryIn.Seconds()); err != nil {
+		return errors.Wrap(err, "failed to save webhook delivery failure")
+	}
+
+	return nil
+}
+
+func scanWebhookDelivery(row pgx.Row) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	var payload []byte
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts, &delivery.LastStatusCode,
+		&delivery.LastError, &delivery.NextAttemptAt, &delivery.CreatedAt, &delivery.DeliveredAt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan webhook delivery")
+	}
+	delivery.Payload = payload
+
+	return &delivery, nil
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// Заголовок с API ключом, вместо него можно передать Authorization: Bearer <ключ или JWT>
+const headerAPIKey = "X-API-Key"
+
+// Проверяем API ключ или JWT и кладем вызывающего в контекст запроса
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential := r.Header.Get(headerAPIKey)
+		if credential == "" {
+			if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+				credential = strings.TrimSpace(token)
+			}
+		}
+		if credential == "" {
+			unauthorized(w)
+			return
+		}
+
+		principal, err := h.auth.Authenticate(r.Context(), credential)
+		if err != nil {
+			if errors.Is(err, models.ErrUnauthorized) {
+				h.log.Debug().Err(err).Msg("authentication failed")
+				unauthorized(w)
+				return
+			}
+			h.log.Error().Err(err).Msg("failed to authenticate")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(models.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// Пропускаем только вызывающих с правом scope, вызывается после Authenticate
+func (h *Handler) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := models.PrincipalFromContext(r.Context())
+			if !ok {
+				unauthorized(w)
+				return
+			}
+			if !principal.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="media", error="insufficient_scope", scope="%s"`, scope))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="media"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// Выпускаем API ключ, сам ключ возвращается только в этом ответе
+// Тело: {"owner_id": "...", "name": "...", "admin": false, "tenant_id": "..."}
+// Ключ для чужого арендатора может выпустить только оператор, остальным - 403
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var key models.APIKey
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&key); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Ключ всегда генерируется сервером
+	key.Key = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.auth.CreateAPIKey(r.Context(), &key); err != nil {
+		if errors.Is(err, models.ErrInvalidOwner) || errors.Is(err, models.ErrInvalidTenant) {
+			h.log.Error().Err(err).Msg("invalid api key owner")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, models.ErrForbidden) {
+			h.log.Error().Err(err).Msg("api key for another tenant")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to create api key")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal api key")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// Получаем API ключи арендатора вызывающего без самих ключей
+func (h *Handler) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	keys, err := h.auth.GetAPIKeys(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to get api keys")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(keys)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal api keys")
+		return
+	}
+	w.Write(data)
+}
+
+// Отзываем API ключ
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = h.auth.RevokeAPIKey(r.Context(), id); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to revoke api key")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
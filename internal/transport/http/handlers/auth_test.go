@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// Вызывающие по токенам вместо проверки ключей и JWT
+type fakeAuth struct {
+	AuthService
+	principals map[string]*models.Principal
+}
+
+func (f *fakeAuth) Authenticate(_ context.Context, credential string) (*models.Principal, error) {
+	if credential == "broken" {
+		return nil, errors.New("database is down")
+	}
+	principal, ok := f.principals[credential]
+	if !ok {
+		return nil, models.ErrUnauthorized
+	}
+	return principal, nil
+}
+
+// Права вызывающего проверяются после аутентификации, API ключ и JWT дают одинаковые ответы
+func TestAuthenticateRequireScope(t *testing.T) {
+	auth := &fakeAuth{principals: map[string]*models.Principal{
+		"writer": {TenantID: "acme", OwnerID: "alice", Scopes: []string{models.ScopeUploadsRead, models.ScopeUploadsWrite}},
+		"reader": {TenantID: "acme", OwnerID: "bob", Scopes: []string{models.ScopeUploadsRead}},
+	}}
+	h := New(zerolog.Nop(), nil, nil, nil, nil, auth, UploadLimits{})
+	write := h.Authenticate(h.RequireScope(models.ScopeUploadsWrite)(okHandler()))
+	admin := h.Authenticate(h.RequireScope(models.ScopeAdmin)(okHandler()))
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		header  string
+		value   string
+		want    int
+	}{
+		{"bearer", write, "Authorization", "Bearer writer", http.StatusOK},
+		{"api key header", write, headerAPIKey, "writer", http.StatusOK},
+		{"missing scope", write, "Authorization", "Bearer reader", http.StatusForbidden},
+		{"not admin", admin, "Authorization", "Bearer writer", http.StatusForbidden},
+		{"unknown credential", write, "Authorization", "Bearer stranger", http.StatusUnauthorized},
+		{"no credential", write, "", "", http.StatusUnauthorized},
+		{"auth failure", write, "Authorization", "Bearer broken", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		rec := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusForbidden && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: WWW-Authenticate is not set", tt.name)
+		}
+	}
+}
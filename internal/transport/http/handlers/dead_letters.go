@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// Получаем недоставленные задачи, по умолчанию только необработанные
+func (h *Handler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = models.DeadLetterStatusDead
+	case "all":
+		status = ""
+	case models.DeadLetterStatusDead, models.DeadLetterStatusRetried, models.DeadLetterStatusDiscarded:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	deadLetters, err := h.dlqService.GetDeadLetters(r.Context(), status)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to get dead letters")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(deadLetters)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal dead letters")
+		return
+	}
+	w.Write(data)
+}
+
+// Получаем недоставленную задачу по id
+func (h *Handler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	deadLetter, err := h.dlqService.GetDeadLetter(r.Context(), id)
+	if err != nil {
+		h.writeDeadLetterError(w, err, "failed to get dead letter")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(deadLetter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal dead letter")
+		return
+	}
+	w.Write(data)
+}
+
+// Возвращаем недоставленную задачу в очередь
+func (h *Handler) RetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = h.dlqService.Retry(r.Context(), id); err != nil {
+		h.writeDeadLetterError(w, err, "failed to retry dead letter")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Отказываемся от недоставленной задачи
+func (h *Handler) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = h.dlqService.Discard(r.Context(), id); err != nil {
+		h.writeDeadLetterError(w, err, "failed to discard dead letter")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Код ответа по ошибке сервиса
+func (h *Handler) writeDeadLetterError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, models.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		h.log.Error().Err(err).Msg(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
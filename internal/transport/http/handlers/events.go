@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// Как часто отправлять комментарий, чтобы прокси не закрывали простаивающее соединение
+const eventsKeepAlive = 15 * time.Second
+
+// Поток событий о миниатюрах загрузки (Server-Sent Events)
+// Первым событием "upload" отправляется текущее состояние, затем события со статусами задач
+func (h *Handler) UploadEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Msg("streaming is not supported")
+		return
+	}
+
+	// Подписываемся до чтения состояния, чтобы не пропустить события между ними
+	events, unsubscribe := h.events.Subscribe(id)
+	defer unsubscribe()
+
+	upload, err := h.service.GetDataId(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to get upload for events")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if err = writeEvent(w, "upload", upload); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			// Сервер останавливается
+			if !ok {
+				return
+			}
+			if err = writeEvent(w, event.Status, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Пишем одно событие в формате SSE
+func writeEvent(w http.ResponseWriter, name string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// Отдаем оригинал изображения
+func (h *Handler) GetOriginal(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	file, err := h.service.GetOriginal(r.Context(), id)
+	if err != nil {
+		h.writeFileError(w, err, "failed to get original")
+		return
+	}
+
+	h.serveImage(w, r, file)
+}
+
+// Отдаем миниатюру изображения по имени пресета
+func (h *Handler) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	file, err := h.service.GetThumbnail(r.Context(), id, vars["preset"])
+	if err != nil {
+		h.writeFileError(w, err, "failed to get thumbnail")
+		return
+	}
+
+	h.serveImage(w, r, file)
+}
+
+// Отдаем содержимое файла
+// http.ServeContent сам обрабатывает Range, If-None-Match и If-Modified-Since
+func (h *Handler) serveImage(w http.ResponseWriter, r *http.Request, file *models.ImageFile) {
+	defer func() {
+		if err := file.Content.Close(); err != nil {
+			h.log.Error().Err(err).Send()
+		}
+	}()
+
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("ETag", imageETag(file))
+	if file.Immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeContent(w, r, file.Name, file.ModTime, file.Content)
+}
+
+// ETag по имени, размеру и времени изменения файла
+func imageETag(file *models.ImageFile) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s:%d:%d", file.Name, file.Size, file.ModTime.UnixNano())))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// Код ответа по ошибке сервиса
+func (h *Handler) writeFileError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, models.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.log.Error().Err(err).Msg(msg)
+	w.WriteHeader(http.StatusInternalServerError)
+}
@@ -3,27 +3,117 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
+	"github.com/Yury132/Golang-Task-2/internal/imaging"
 	"github.com/Yury132/Golang-Task-2/internal/models"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 )
 
 type Service interface {
-	// Загружаем изображение
-	UploadPhoto(ctx context.Context, data []byte, metaInfo *models.ImageMeta, thumbSize int) error
+	// Загружаем изображение, повторная загрузка того же содержимого возвращает существующую запись
+	UploadPhoto(ctx context.Context, r io.Reader, metaInfo *models.ImageMeta, opts models.ThumbnailOptions, force bool) (*models.UploadResult, error)
 	// Получаем информацию о картинках
 	GetData(ctx context.Context) ([]models.AllImages, error)
 	// Получаем информацию о картинках по id
-	GetDataId(ctx context.Context, id int) ([]models.AllImages, error)
+	GetDataId(ctx context.Context, id int) (*models.UploadInfo, error)
+	// Получаем страницу списка загрузок с миниатюрами
+	ListUploads(ctx context.Context, filter models.UploadFilter) (*models.UploadPage, error)
+	// Получаем состояние задачи на миниатюру
+	GetJob(ctx context.Context, id int) (*models.ThumbnailJob, error)
+	// Открываем оригинал изображения
+	GetOriginal(ctx context.Context, id int) (*models.ImageFile, error)
+	// Открываем миниатюру изображения по имени пресета
+	GetThumbnail(ctx context.Context, id int, preset string) (*models.ImageFile, error)
+	// Ищем похожие изображения, maxDistance < 0 - расстояние из конфигурации
+	GetSimilar(ctx context.Context, id int, maxDistance int) ([]models.SimilarImage, error)
+	// Удаляем загрузку, до окончательного удаления ее можно восстановить
+	DeleteUpload(ctx context.Context, id int) error
+	// Восстанавливаем удаленную загрузку
+	RestoreUpload(ctx context.Context, id int) error
+	// Получаем занятое арендатором место и его лимиты
+	GetUsage(ctx context.Context) (*models.TenantUsage, error)
+}
+
+type DeadLetterService interface {
+	// Получаем недоставленные задачи
+	GetDeadLetters(ctx context.Context, status string) ([]models.DeadLetter, error)
+	// Получаем недоставленную задачу по id
+	GetDeadLetter(ctx context.Context, id int) (*models.DeadLetter, error)
+	// Возвращаем задачу в очередь на обработку
+	Retry(ctx context.Context, id int) error
+	// Отказываемся от задачи
+	Discard(ctx context.Context, id int) error
+}
+
+type EventService interface {
+	// Подписываемся на события загрузки, возвращаемая функция отменяет подписку
+	Subscribe(uploadID int) (<-chan models.ThumbnailEvent, func())
+}
+
+type WebhookService interface {
+	// Регистрируем вебхук, пустой ключ генерируется
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+	// Получаем зарегистрированные вебхуки
+	GetWebhooks(ctx context.Context) ([]models.Webhook, error)
+	// Удаляем вебхук
+	DeleteWebhook(ctx context.Context, id int) error
+	// Получаем журнал доставки вебхука
+	GetDeliveries(ctx context.Context, webhookID int, status string, limit int) ([]models.WebhookDelivery, error)
+}
+
+type AuthService interface {
+	// Проверяем API ключ или JWT и получаем вызывающего
+	Authenticate(ctx context.Context, credential string) (*models.Principal, error)
+	// Выпускаем ключ, сам ключ возвращается только здесь
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	// Получаем все ключи без самих ключей
+	GetAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	// Отзываем ключ
+	RevokeAPIKey(ctx context.Context, id int) error
+}
+
+type RateLimiter interface {
+	// Можно ли выполнить запрос с ключом key, иначе - через сколько повторить
+	Allow(key string) (bool, time.Duration)
+}
+
+// Ограничения загрузок
+type UploadLimits struct {
+	// Максимальный размер тела запроса на загрузку
+	MaxSize int64
+	// nil - частота загрузок не ограничена
+	Limiter RateLimiter
+	// Сколько загрузок может идти одновременно, 0 - без ограничения
+	MaxConcurrent int
+	// Сколько загрузка может читать тело, заняв место, 0 - без ограничения
+	ReadTimeout time.Duration
 }
 
 type Handler struct {
-	log     zerolog.Logger
-	service Service
+	log        zerolog.Logger
+	service    Service
+	dlqService DeadLetterService
+	events     EventService
+	webhooks   WebhookService
+	auth       AuthService
+	// Максимальный размер тела запроса на загрузку
+	maxUploadSize int64
+	// nil - частота загрузок не ограничена
+	limiter RateLimiter
+	// Свободные места для одновременных загрузок, nil - без ограничения
+	uploadSlots chan struct{}
+	// Сколько загрузка может читать тело, заняв место, 0 - без ограничения
+	uploadReadTimeout time.Duration
 }
 
 // Проверка работоспособности
@@ -46,21 +136,57 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 
 	// Получаем параметр из запроса
+	// Размер необязателен: миниатюры по пресетам из конфигурации создаются всегда
 	queryParams := r.URL.Query()
-	scaleStr := queryParams.Get("size")
-	// Преобразуем из string в int
-	size, err := strconv.Atoi(scaleStr)
-	if err != nil {
-		h.log.Error().Err(err).Msg("invalid query param - size")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	var opts models.ThumbnailOptions
+	if scaleStr := queryParams.Get("size"); scaleStr != "" {
+		// Преобразуем из string в int
+		var err error
+		opts.Size, err = strconv.Atoi(scaleStr)
+		if err != nil || opts.Size <= 0 {
+			h.log.Error().Err(err).Msg("invalid query param - size")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	// Формат и качество миниатюр, по умолчанию берутся из пресетов
+	if formatStr := queryParams.Get("format"); formatStr != "" {
+		var err error
+		opts.Format, err = imaging.ParseFormat(formatStr)
+		if err != nil {
+			h.log.Error().Err(err).Msg("invalid query param - format")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if qualityStr := queryParams.Get("quality"); qualityStr != "" {
+		var err error
+		opts.Quality, err = strconv.Atoi(qualityStr)
+		if err != nil || opts.Quality < 1 || opts.Quality > 100 {
+			h.log.Error().Err(err).Msg("invalid query param - quality")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Сохранить новую копию, даже если такое содержимое уже загружено
+	var force bool
+	if forceStr := queryParams.Get("force"); forceStr != "" {
+		var err error
+		force, err = strconv.ParseBool(forceStr)
+		if err != nil {
+			h.log.Error().Err(err).Msg("invalid query param - force")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Получаем файл из запроса
-	file, handler, err := r.FormFile("file")
+	// Файл читаем потоком, не загружая его целиком в память
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize)
+	file, err := uploadPart(r)
 	if err != nil {
 		h.log.Error().Err(err).Msg("failed to upload file")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(uploadErrorStatus(err))
 		return
 	}
 	defer func() {
@@ -69,29 +195,92 @@ func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Читаем файл
-	data, err := io.ReadAll(file)
-	if err != nil || data == nil {
-		h.log.Error().Err(err).Msg("failed to read the file")
-		w.WriteHeader(http.StatusBadRequest)
+	// Получаем данные о картинке по заголовку файла
+	metaInfo, data, err := models.ReadImageMeta(file, rawFileName(file))
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to collect meta info")
+		w.WriteHeader(uploadErrorStatus(err))
 		return
 	}
 
-	// Получаем данные о картинке
-	metaInfo, err := models.CollectImageMeta(data, handler.Filename)
+	// Загружаем картинку
+	result, err := h.service.UploadPhoto(r.Context(), data, metaInfo, opts, force)
 	if err != nil {
-		h.log.Error().Err(err).Msg("failed to collect meta info")
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(uploadErrorStatus(err))
 		return
 	}
 
-	// Загружаем картинку
-	if err = h.service.UploadPhoto(r.Context(), data, metaInfo, size); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	// Кодируем
+	response, err := json.Marshal(result)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to marshal upload result")
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/uploads/%d", result.UploadID))
+	// Новая загрузка принята, миниатюры создаются в фоне - их состояние в GET /jobs/{id}
+	if result.Duplicate {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	w.Write(response)
+}
+
+// Ищем в multipart-форме часть с файлом, остальные части пропускаем
+func uploadPart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", models.ErrInvalidUpload, err)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				err = http.ErrMissingFile
+			}
+			return nil, fmt.Errorf("%w: %w", models.ErrInvalidUpload, err)
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// Имя файла как его прислал клиент
+// part.FileName() молча отрезает путь, а нам нужно отклонять такие имена
+func rawFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
+}
+
+// Код ответа для ошибки загрузки: слишком большой файл - 413, исчерпан лимит арендатора - 403,
+// некорректный запрос - 400, сбой хранилища или БД - 500
+func uploadErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, models.ErrQuotaExceeded) {
+		return http.StatusForbidden
+	}
+	// Клиент не успел передать тело, пока держал место загрузки
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return http.StatusRequestTimeout
+	}
+	if errors.Is(err, models.ErrInvalidUpload) || errors.Is(err, models.ErrInvalidFileName) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
 }
 
 // Получаем информацию о картинках
@@ -124,14 +313,18 @@ func (h *Handler) GetDataId(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	images, err := h.service.GetDataId(r.Context(), id)
+	upload, err := h.service.GetDataId(r.Context(), id)
 	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		h.log.Error().Err(err).Msg("failed to get images id")
 		return
 	}
 	// Кодируем
-	data, err := json.Marshal(images)
+	data, err := json.Marshal(upload)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		h.log.Error().Err(err).Msg("failed to marshal images id")
@@ -140,9 +333,22 @@ func (h *Handler) GetDataId(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func New(log zerolog.Logger, service Service) *Handler {
-	return &Handler{
-		log:     log,
-		service: service,
+// limits - ограничения загрузок, нулевые поля - без ограничения
+func New(log zerolog.Logger, service Service, dlqService DeadLetterService, events EventService, webhooks WebhookService, auth AuthService, limits UploadLimits) *Handler {
+	h := &Handler{
+		log:               log,
+		service:           service,
+		dlqService:        dlqService,
+		events:            events,
+		webhooks:          webhooks,
+		auth:              auth,
+		maxUploadSize:     limits.MaxSize,
+		limiter:           limits.Limiter,
+		uploadReadTimeout: limits.ReadTimeout,
+	}
+	if limits.MaxConcurrent > 0 {
+		h.uploadSlots = make(chan struct{}, limits.MaxConcurrent)
 	}
+
+	return h
 }
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+)
+
+func TestUploadErrorStatus(t *testing.T) {
+	_, _, decodeErr := models.ReadImageMeta(bytes.NewReader([]byte("not an image")), "a.png")
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"too large", fmt.Errorf("%w: %w", models.ErrInvalidUpload, &http.MaxBytesError{Limit: 1}), http.StatusRequestEntityTooLarge},
+		{"quota", models.ErrQuotaExceeded, http.StatusForbidden},
+		{"slow client", os.ErrDeadlineExceeded, http.StatusRequestTimeout},
+		{"not an image", decodeErr, http.StatusBadRequest},
+		{"invalid name", models.ErrInvalidFileName, http.StatusBadRequest},
+		{"storage", fmt.Errorf("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := uploadErrorStatus(tt.err); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
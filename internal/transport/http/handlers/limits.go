@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+)
+
+// Ограничиваем частоту запросов: у вызывающего своя корзина токенов, без ключа - у IP
+// Вызывается после Authenticate, иначе все запросы считаются по IP
+func (h *Handler) RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := "ip:" + clientIP(r)
+		if principal, ok := models.PrincipalFromContext(r.Context()); ok {
+			key = "owner:" + principal.TenantID + "/" + principal.OwnerID
+		}
+
+		if ok, wait := h.limiter.Allow(key); !ok {
+			h.log.Debug().Str("key", key).Dur("retry_after", wait).Msg("rate limit exceeded")
+			tooManyRequests(w, wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ограничиваем число загрузок, которые читаются и разбираются одновременно
+// Лишние не ждут в очереди, а сразу получают 429
+// Тело читается потоком вместе с обработкой, поэтому чтение ограничено по времени:
+// медленный клиент не может держать место бесконечно
+func (h *Handler) LimitConcurrentUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.uploadSlots == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case h.uploadSlots <- struct{}{}:
+			defer func() { <-h.uploadSlots }()
+		default:
+			h.log.Debug().Msg("too many concurrent uploads")
+			tooManyRequests(w, time.Second)
+			return
+		}
+
+		if h.uploadReadTimeout > 0 {
+			err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(h.uploadReadTimeout))
+			if err != nil && !errors.Is(err, http.ErrNotSupported) {
+				h.log.Error().Err(err).Msg("failed to set upload read deadline")
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ответ 429, Retry-After в целых секундах, не меньше одной
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// IP клиента без порта
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/Yury132/Golang-Task-2/internal/ratelimit"
+	"github.com/rs/zerolog"
+)
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Запрос на загрузку от владельца owner, пустой - без вызывающего
+func uploadRequest(owner string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	if owner != "" {
+		req = req.WithContext(models.WithPrincipal(req.Context(), &models.Principal{TenantID: models.DefaultTenant, OwnerID: owner}))
+	}
+	return req
+}
+
+func TestRateLimitPerCaller(t *testing.T) {
+	h := New(zerolog.Nop(), nil, nil, nil, nil, nil, UploadLimits{Limiter: ratelimit.New(0.5, 1)})
+	handler := h.RateLimit(okHandler())
+
+	serve := func(owner string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, uploadRequest(owner))
+		return rec
+	}
+
+	if rec := serve("alice"); rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", rec.Code)
+	}
+	rec := serve("alice")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status = %d, want 429", rec.Code)
+	}
+	// Токен появится через 1/rate = 2 секунды
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After = %q, want 2", got)
+	}
+
+	// У другого владельца и у запросов без вызывающего свои корзины
+	if rec := serve("bob"); rec.Code != http.StatusOK {
+		t.Fatalf("other owner status = %d, want 200", rec.Code)
+	}
+	if rec := serve(""); rec.Code != http.StatusOK {
+		t.Fatalf("anonymous status = %d, want 200", rec.Code)
+	}
+}
+
+func TestLimitConcurrentUploads(t *testing.T) {
+	h := New(zerolog.Nop(), nil, nil, nil, nil, nil, UploadLimits{MaxConcurrent: 1})
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := h.LimitConcurrentUploads(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(first, uploadRequest("alice"))
+	}()
+	<-entered
+
+	// Единственное место занято - вторая загрузка не ждет, а сразу получает 429
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, uploadRequest("bob"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("Retry-After = %q, want 1", got)
+	}
+
+	close(release)
+	<-done
+	if first.Code != http.StatusOK {
+		t.Fatalf("first upload status = %d, want 200", first.Code)
+	}
+
+	// Место освободилось
+	handler = h.LimitConcurrentUploads(okHandler())
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, uploadRequest("bob"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status after release = %d, want 200", rec.Code)
+	}
+}
+
+// Медленный клиент получает 408 по истечении времени на чтение тела и освобождает место
+func TestLimitConcurrentUploadsReadDeadline(t *testing.T) {
+	h := New(zerolog.Nop(), nil, nil, nil, nil, nil, UploadLimits{MaxConcurrent: 1, ReadTimeout: 100 * time.Millisecond})
+	server := httptest.NewServer(h.LimitConcurrentUploads(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(uploadErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Обещаем тело в 1 КиБ, а передаем несколько байт и замолкаем
+	fmt.Fprintf(conn, "POST /uploads HTTP/1.1\r\nHost: test\r\nContent-Length: 1024\r\n\r\nslow")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("status = %d, want 408", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL, "image/png", strings.NewReader("fast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status after slow upload = %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// Получаем изображения, похожие на загруженное
+// Необязательный параметр distance - максимальное расстояние Хэмминга от 0 до 64
+func (h *Handler) GetSimilar(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	maxDistance := -1
+	if distanceStr := r.URL.Query().Get("distance"); distanceStr != "" {
+		maxDistance, err = strconv.Atoi(distanceStr)
+		if err != nil || maxDistance < 0 || maxDistance > 64 {
+			h.log.Error().Err(err).Msg("invalid query param - distance")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	images, err := h.service.GetSimilar(r.Context(), id, maxDistance)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, models.ErrConflict):
+			// Хэш еще не посчитан, миниатюры в обработке
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			h.log.Error().Err(err).Msg("failed to get similar images")
+		}
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(images)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal similar images")
+		return
+	}
+	w.Write(data)
+}
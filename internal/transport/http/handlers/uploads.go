@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// Размер страницы списка загрузок по умолчанию и максимальный
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// Получаем страницу списка загрузок
+// Параметры: type, name (префикс имени файла), min_width, max_width, min_height, max_height,
+// from и to (RFC 3339), sort (upload_at, id, name, width, height), order (asc, desc), limit, cursor
+func (h *Handler) ListUploads(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseUploadFilter(r.URL.Query())
+	if err != nil {
+		h.log.Error().Err(err).Msg("invalid list uploads query")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	page, err := h.service.ListUploads(r.Context(), *filter)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to list uploads")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(page)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal uploads")
+		return
+	}
+	w.Write(data)
+}
+
+// Разбираем фильтры списка загрузок из параметров запроса
+func parseUploadFilter(query url.Values) (*models.UploadFilter, error) {
+	filter := &models.UploadFilter{
+		Type:       query.Get("type"),
+		NamePrefix: query.Get("name"),
+		Sort:       models.SortUploadAt,
+		Desc:       true,
+		Cursor:     query.Get("cursor"),
+		Limit:      defaultPageLimit,
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"min_width", &filter.MinWidth},
+		{"max_width", &filter.MaxWidth},
+		{"min_height", &filter.MinHeight},
+		{"max_height", &filter.MaxHeight},
+		{"limit", &filter.Limit},
+	}
+	for _, param := range ints {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid query param - %s", param.name)
+		}
+		*param.dst = n
+	}
+	if filter.Limit < 1 || filter.Limit > maxPageLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+	}
+
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"from", &filter.From},
+		{"to", &filter.To},
+	}
+	for _, param := range times {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query param - %s", param.name)
+		}
+		// Время загрузки в БД хранится без часового пояса, в UTC
+		*param.dst = t.UTC()
+	}
+
+	switch sort := query.Get("sort"); sort {
+	case "":
+	case models.SortUploadAt, models.SortID, models.SortName, models.SortWidth, models.SortHeight:
+		filter.Sort = sort
+	default:
+		return nil, fmt.Errorf("invalid query param - sort")
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		filter.Desc = false
+	default:
+		return nil, fmt.Errorf("invalid query param - order")
+	}
+
+	return filter, nil
+}
+
+// Удаляем загрузку, до окончательного удаления ее можно восстановить
+func (h *Handler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = h.service.DeleteUpload(r.Context(), id); err != nil {
+		h.writeUploadError(w, err, "failed to delete upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Восстанавливаем удаленную загрузку
+func (h *Handler) RestoreUpload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = h.service.RestoreUpload(r.Context(), id); err != nil {
+		h.writeUploadError(w, err, "failed to restore upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Код ответа по ошибке сервиса
+// 404 - загрузки нет или окно восстановления истекло, 409 - то же содержимое загружено снова
+func (h *Handler) writeUploadError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, models.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		h.log.Error().Err(err).Msg(msg)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Получаем занятое арендатором место и его лимиты
+func (h *Handler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	usage, err := h.service.GetUsage(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to get usage")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(usage)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal usage")
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/gorilla/mux"
+)
+
+// Размер журнала доставки по умолчанию и максимальный
+const (
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+// Регистрируем вебхук, ключ подписи возвращается только в этом ответе
+// Тело: {"url": "...", "events": ["upload.created", ...], "secret": "..."}, пустой events - все события
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook models.Webhook
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&webhook); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.webhooks.CreateWebhook(r.Context(), &webhook); err != nil {
+		if errors.Is(err, models.ErrInvalidWebhook) {
+			h.log.Error().Err(err).Msg("invalid webhook")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to create webhook")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal webhook")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// Получаем зарегистрированные вебхуки
+func (h *Handler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	webhooks, err := h.webhooks.GetWebhooks(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to get webhooks")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(webhooks)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal webhooks")
+		return
+	}
+	w.Write(data)
+}
+
+// Удаляем вебхук вместе с журналом доставки
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = h.webhooks.DeleteWebhook(r.Context(), id); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to delete webhook")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Получаем журнал доставки вебхука, новые записи первыми
+// Параметры: status (pending, delivered, failed), limit
+func (h *Handler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	switch status {
+	case "", models.WebhookDeliveryPending, models.WebhookDeliveryDelivered, models.WebhookDeliveryFailed:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit := defaultDeliveriesLimit
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxDeliveriesLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	deliveries, err := h.webhooks.GetDeliveries(r.Context(), id, status, limit)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to get webhook deliveries")
+		return
+	}
+	// Кодируем
+	data, err := json.Marshal(deliveries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.log.Error().Err(err).Msg("failed to marshal webhook deliveries")
+		return
+	}
+	w.Write(data)
+}
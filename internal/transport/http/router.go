@@ -3,6 +3,7 @@ package http
 import (
 	"net/http"
 
+	"github.com/Yury132/Golang-Task-2/internal/models"
 	"github.com/Yury132/Golang-Task-2/internal/transport/http/handlers"
 	"github.com/gorilla/mux"
 )
@@ -10,12 +11,56 @@ import (
 func InitRoutes(h *handlers.Handler) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/uploads", h.Upload).Methods(http.MethodPost)
+	// Проверка работоспособности доступна без ключа
 	r.HandleFunc("/health", h.Health).Methods(http.MethodGet)
-	// Получаем информацию о картинках
-	r.HandleFunc("/get-data", h.GetData).Methods(http.MethodGet)
+
+	// Остальное - только с API ключом или JWT, загрузки и вебхуки видны лишь своему владельцу
+	api := r.NewRoute().Subrouter()
+	api.Use(h.Authenticate)
+
+	// Право проверяем на каждом маршруте: один путь с разными методами требует разных прав
+	read := func(f http.HandlerFunc) http.Handler { return h.RequireScope(models.ScopeUploadsRead)(f) }
+	write := func(f http.HandlerFunc) http.Handler { return h.RequireScope(models.ScopeUploadsWrite)(f) }
+	admin := func(f http.HandlerFunc) http.Handler { return h.RequireScope(models.ScopeAdmin)(f) }
+
+	// Загрузки ограничены по частоте для каждого вызывающего и по числу одновременных
+	upload := h.LimitConcurrentUploads(http.HandlerFunc(h.Upload))
+	api.Handle("/uploads", h.RateLimit(h.RequireScope(models.ScopeUploadsWrite)(upload))).Methods(http.MethodPost)
+	// Список загрузок с фильтрами и постраничным выводом
+	api.Handle("/uploads", read(h.ListUploads)).Methods(http.MethodGet)
+	// Получаем информацию о картинках, устарело - используйте GET /uploads
+	api.Handle("/get-data", read(h.GetData)).Methods(http.MethodGet)
 	// Получаем информацию о картинках по id
-	r.HandleFunc("/uploads/{id:[0-9]+}", h.GetDataId).Methods(http.MethodGet)
+	api.Handle("/uploads/{id:[0-9]+}", read(h.GetDataId)).Methods(http.MethodGet)
+	// Удаление и восстановление в течение окна очистки
+	api.Handle("/uploads/{id:[0-9]+}", write(h.DeleteUpload)).Methods(http.MethodDelete)
+	api.Handle("/uploads/{id:[0-9]+}/restore", write(h.RestoreUpload)).Methods(http.MethodPost)
+	// Содержимое оригинала и миниатюр
+	api.Handle("/uploads/{id:[0-9]+}/original", read(h.GetOriginal)).Methods(http.MethodGet, http.MethodHead)
+	api.Handle("/uploads/{id:[0-9]+}/thumbnails/{preset}", read(h.GetThumbnail)).Methods(http.MethodGet, http.MethodHead)
+	api.Handle("/uploads/{id:[0-9]+}/similar", read(h.GetSimilar)).Methods(http.MethodGet)
+	// Поток событий о создании миниатюр
+	api.Handle("/uploads/{id:[0-9]+}/events", read(h.UploadEvents)).Methods(http.MethodGet)
+	// Состояние задачи на миниатюру
+	api.Handle("/jobs/{id:[0-9]+}", read(h.GetJob)).Methods(http.MethodGet)
+	// Занятое арендатором место и лимиты
+	api.Handle("/usage", read(h.GetUsage)).Methods(http.MethodGet)
+	// Вебхуки и журнал их доставки
+	api.Handle("/webhooks", write(h.CreateWebhook)).Methods(http.MethodPost)
+	api.Handle("/webhooks", read(h.GetWebhooks)).Methods(http.MethodGet)
+	api.Handle("/webhooks/{id:[0-9]+}", write(h.DeleteWebhook)).Methods(http.MethodDelete)
+	api.Handle("/webhooks/{id:[0-9]+}/deliveries", read(h.GetWebhookDeliveries)).Methods(http.MethodGet)
+
+	// Общие для всех владельцев ресурсы
+	// Недоставленные задачи
+	api.Handle("/dead-letters", admin(h.GetDeadLetters)).Methods(http.MethodGet)
+	api.Handle("/dead-letters/{id:[0-9]+}", admin(h.GetDeadLetter)).Methods(http.MethodGet)
+	api.Handle("/dead-letters/{id:[0-9]+}/retry", admin(h.RetryDeadLetter)).Methods(http.MethodPost)
+	api.Handle("/dead-letters/{id:[0-9]+}", admin(h.DiscardDeadLetter)).Methods(http.MethodDelete)
+	// API ключи
+	api.Handle("/api-keys", admin(h.CreateAPIKey)).Methods(http.MethodPost)
+	api.Handle("/api-keys", admin(h.GetAPIKeys)).Methods(http.MethodGet)
+	api.Handle("/api-keys/{id:[0-9]+}", admin(h.RevokeAPIKey)).Methods(http.MethodDelete)
 
 	return r
 }
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/Yury132/Golang-Task-2/internal/transport/http/handlers"
@@ -25,8 +26,9 @@ func (s *Server) WithHandler(handler *handlers.Handler) *Server {
 	return s
 }
 
+// Запуск сервера, штатная остановка через Shutdown ошибкой не считается
 func (s *Server) Run() error {
-	if err := s.ListenAndServe(); err != nil {
+	if err := s.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 
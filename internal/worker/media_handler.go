@@ -1,7 +1,9 @@
 package worker
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/Yury132/Golang-Task-2/internal/models"
 	"github.com/rs/zerolog"
@@ -9,56 +11,228 @@ import (
 	"github.com/Yury132/Golang-Task-2/internal/worker/pool"
 )
 
+// Сколько ждать задачи в одном запросе к Nats
+const fetchWait = 5 * time.Second
+
+// Пауза перед новым запросом после ошибки Nats
+const fetchRetryDelay = time.Second
+
+// Срок подтверждения продлевается не дольше, чем на столько сроков подтверждения:
+// зависшая задача не должна держать сообщение вечно, после этого оно будет доставлено снова
+const maxProgressExtensions = 30
+
 // Эти функции будет вызывать воркер пул
 // Связь с "media_service"
 type MediaService interface {
 	// Создание миниатюры
 	CreateThumbnail(info *models.InfoForThumbnail) error
-	// Получаем сообщение из Nats
-	GetTaskForProcessing() (*models.InfoForThumbnail, error)
+	// Получаем из Nats не больше max задач и передаем их в handler по мере поступления, ждем не дольше wait
+	FetchTasks(max int, wait time.Duration, handler func(task *models.Task)) error
+	// Перекладываем в очередь недоставленных задачи, доставки которых исчерпаны без ответа обработчика,
+	// возвращаем функцию остановки
+	WatchMaxDeliveries() (func(), error)
+	// Подтверждаем сообщение или возвращаем его в очередь по результату обработки
+	FinishTask(task *models.Task, taskErr error) error
+	// Продлеваем срок подтверждения сообщения, пока задача ждет воркера или выполняется
+	ProgressTask(task *models.Task) error
+	// Возвращаем необработанное сообщение в очередь без задержки
+	ReleaseTask(task *models.Task) error
 }
 
 type MediaHandler struct {
 	log          zerolog.Logger
 	mediaService MediaService
 	pool         *pool.Pool
+	batchSize    int
+	// Как часто продлевать срок подтверждения сообщения, 0 - не продлевать
+	progressInterval time.Duration
+	// Сколько всего продлевать срок подтверждения одной задачи
+	progressLimit time.Duration
+	// Задачи для воркеров
+	jobs chan func()
+	// Места для задач, полученных из Nats, но еще не обработанных
+	inFlight chan struct{}
+	quit     chan struct{}
+	// Цикл получения задач и принятые задачи, которые еще не выполнены и не возвращены в Nats
+	pending sync.WaitGroup
+	// Остановка слежения за исчерпанными доставками
+	stopWatch func()
 }
 
 // Запуск
-func (mh *MediaHandler) Start() {
-	// Передаем функцию, которую будет выполнять воркер пул
-	mh.pool.RunBackground(mh.createThumbnail)
+func (mh *MediaHandler) Start() error {
+	stop, err := mh.mediaService.WatchMaxDeliveries()
+	if err != nil {
+		return err
+	}
+	mh.stopWatch = stop
+
+	// Воркеры разбирают общий канал задач
+	mh.pool.RunBackground(mh.jobs)
+
+	mh.pending.Add(1)
+	go mh.fetch()
+
+	return nil
 }
 
 // Остановка
-func (mh *MediaHandler) Shutdown() {
-	mh.pool.Stop()
+// Начатые миниатюры доделываются в пределах ctx, ожидающие задачи возвращаются в Nats
+func (mh *MediaHandler) Shutdown(ctx context.Context) error {
+	// Сначала перестаем получать сообщения, потом останавливаем воркеров
+	if mh.stopWatch != nil {
+		mh.stopWatch()
+	}
+	close(mh.quit)
+	if err := mh.pool.Stop(ctx); err != nil {
+		return err
+	}
+
+	// Задачи, до которых воркеры не дошли, увидят закрытый quit и вернут сообщение в очередь
+	// Ждем и цикл получения: задачи из последнего запроса к Nats тоже надо вернуть
+	done := make(chan struct{})
+	go func() {
+		mh.pending.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case job := <-mh.jobs:
+			job()
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
-// Функция, которую будет выполнять воркер пул
-func (mh *MediaHandler) createThumbnail() {
-	info, err := mh.mediaService.GetTaskForProcessing()
-	if err != nil {
-		mh.log.Error().Err(err).Send()
-		return
+// Запрашиваем задачи из Nats, только когда для них есть свободные места
+// Сообщение, которое ждет места в буфере, доставилось бы повторно по истечении срока подтверждения
+func (mh *MediaHandler) fetch() {
+	defer mh.pending.Done()
+
+	for {
+		// Ждем хотя бы одно место и занимаем еще свободные, но не больше batchSize
+		select {
+		case mh.inFlight <- struct{}{}:
+		case <-mh.quit:
+			return
+		}
+		slots := 1
+	acquire:
+		for slots < mh.batchSize {
+			select {
+			case mh.inFlight <- struct{}{}:
+				slots++
+			default:
+				break acquire
+			}
+		}
+
+		err := mh.mediaService.FetchTasks(slots, fetchWait, func(task *models.Task) {
+			slots--
+			mh.dispatch(task)
+		})
+		// Места, на которые задачи не пришли, освобождаем
+		for ; slots > 0; slots-- {
+			<-mh.inFlight
+		}
+
+		if err != nil {
+			mh.log.Error().Err(err).Msg("failed to fetch tasks")
+			select {
+			case <-time.After(fetchRetryDelay):
+			case <-mh.quit:
+				return
+			}
+		}
 	}
+}
 
-	var wg = new(sync.WaitGroup)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err = mh.mediaService.CreateThumbnail(info); err != nil {
-			mh.log.Error().Err(err).Send()
+// Передаем задачу воркерам, место для нее уже занято, поэтому канал не блокируется
+// После остановки задача не выполняется, а возвращается в очередь
+func (mh *MediaHandler) dispatch(task *models.Task) {
+	mh.pending.Add(1)
+	stopProgress := mh.keepInProgress(task)
+
+	mh.jobs <- func() {
+		defer mh.pending.Done()
+		defer func() { <-mh.inFlight }()
+		defer stopProgress()
+		select {
+		case <-mh.quit:
+			if err := mh.mediaService.ReleaseTask(task); err != nil {
+				mh.log.Error().Err(err).Msg("failed to release task")
+			}
 			return
+		default:
+		}
+		// Задача могла ждать воркера, продлеваем срок сразу
+		mh.progress(task)
+		mh.createThumbnail(task)
+	}
+}
+
+// Пока задача ждет воркера или выполняется, продлеваем срок подтверждения сообщения
+// Возвращаем функцию, которая прекращает продление
+func (mh *MediaHandler) keepInProgress(task *models.Task) func() {
+	if mh.progressInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(mh.progressInterval)
+		defer ticker.Stop()
+		limit := time.NewTimer(mh.progressLimit)
+		defer limit.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mh.progress(task)
+			case <-limit.C:
+				mh.log.Warn().Int("job_id", task.Info.JobID).Msg("task is taking too long, ack wait is no longer extended")
+				<-done
+				return
+			case <-done:
+				return
+			}
 		}
 	}()
-	wg.Wait()
+
+	return func() { close(done) }
+}
+
+func (mh *MediaHandler) progress(task *models.Task) {
+	if err := mh.mediaService.ProgressTask(task); err != nil {
+		mh.log.Error().Err(err).Int("job_id", task.Info.JobID).Msg("failed to extend task ack wait")
+	}
+}
+
+// Функция, которую будет выполнять воркер пул
+func (mh *MediaHandler) createThumbnail(task *models.Task) {
+	err := mh.mediaService.CreateThumbnail(task.Info)
+	if err != nil {
+		mh.log.Error().Err(err).Int("job_id", task.Info.JobID).Msg("failed to create thumbnail")
+	}
+	// Сообщение подтверждается только после обработки
+	if err = mh.mediaService.FinishTask(task, err); err != nil {
+		mh.log.Error().Err(err).Msg("failed to finish task")
+	}
 }
 
-func New(log zerolog.Logger, mediaService MediaService, workersNum int) *MediaHandler {
+// ackWait - срок подтверждения сообщения у получателя Nats, продлеваем его втрое чаще
+func New(log zerolog.Logger, mediaService MediaService, workersNum int, batchSize int, maxInFlight int, ackWait time.Duration) *MediaHandler {
 	return &MediaHandler{
-		log:          log,
-		mediaService: mediaService,
-		pool:         pool.New(log, workersNum),
+		log:              log,
+		mediaService:     mediaService,
+		pool:             pool.New(log, workersNum),
+		batchSize:        batchSize,
+		progressInterval: ackWait / 3,
+		progressLimit:    ackWait * maxProgressExtensions,
+		jobs:             make(chan func(), maxInFlight),
+		inFlight:         make(chan struct{}, maxInFlight),
+		quit:             make(chan struct{}),
 	}
 }
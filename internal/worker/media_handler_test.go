@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yury132/Golang-Task-2/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// Очередь задач вместо Nats, считает полученные, но еще не подтвержденные задачи
+type fakeMediaService struct {
+	mu       sync.Mutex
+	queue    []*models.Task
+	create   func(info *models.InfoForThumbnail)
+	inFlight int
+	maxSeen  int
+	finished int
+	released int
+	progress int
+}
+
+func newFakeMediaService(tasks int, create func(info *models.InfoForThumbnail)) *fakeMediaService {
+	f := &fakeMediaService{create: create}
+	for i := 1; i <= tasks; i++ {
+		f.queue = append(f.queue, &models.Task{Info: &models.InfoForThumbnail{JobID: i}})
+	}
+	return f
+}
+
+func (f *fakeMediaService) CreateThumbnail(info *models.InfoForThumbnail) error {
+	if f.create != nil {
+		f.create(info)
+	}
+	return nil
+}
+
+func (f *fakeMediaService) FetchTasks(max int, wait time.Duration, handler func(task *models.Task)) error {
+	f.mu.Lock()
+	n := len(f.queue)
+	if n > max {
+		n = max
+	}
+	tasks := f.queue[:n]
+	f.queue = f.queue[n:]
+	f.inFlight += n
+	if f.inFlight > f.maxSeen {
+		f.maxSeen = f.inFlight
+	}
+	f.mu.Unlock()
+
+	if n == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, task := range tasks {
+		handler(task)
+	}
+	return nil
+}
+
+func (f *fakeMediaService) WatchMaxDeliveries() (func(), error) {
+	return func() {}, nil
+}
+
+func (f *fakeMediaService) FinishTask(*models.Task, error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+	f.finished++
+	return nil
+}
+
+func (f *fakeMediaService) ProgressTask(*models.Task) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.progress++
+	return nil
+}
+
+func (f *fakeMediaService) ReleaseTask(*models.Task) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+	f.released++
+	return nil
+}
+
+// Снимок счетчиков под блокировкой
+func (f *fakeMediaService) stats() (inFlight, maxSeen, finished, released, progress int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inFlight, f.maxSeen, f.finished, f.released, f.progress
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMediaHandlerBoundsInFlight(t *testing.T) {
+	service := newFakeMediaService(50, func(*models.InfoForThumbnail) {
+		time.Sleep(time.Millisecond)
+	})
+	mh := New(zerolog.Nop(), service, 2, 3, 4, time.Minute)
+	if err := mh.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "all tasks", func() bool {
+		_, _, finished, _, _ := service.stats()
+		return finished == 50
+	})
+	if err := mh.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if _, maxSeen, _, _, _ := service.stats(); maxSeen > 4 {
+		t.Fatalf("%d tasks in flight, want at most 4", maxSeen)
+	}
+}
+
+// Задачи, до которых воркер не дошел, возвращаются в очередь, начатая доделывается
+func TestMediaHandlerShutdownReleasesQueuedTasks(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	service := newFakeMediaService(5, func(*models.InfoForThumbnail) {
+		once.Do(func() { close(started) })
+		<-unblock
+	})
+	mh := New(zerolog.Nop(), service, 1, 5, 5, time.Minute)
+	if err := mh.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	<-started
+	waitFor(t, "fetched tasks", func() bool {
+		inFlight, _, _, _, _ := service.stats()
+		return inFlight == 5
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- mh.Shutdown(context.Background()) }()
+	// Shutdown не должен запускать ожидающие задачи, пока начатая выполняется
+	time.Sleep(10 * time.Millisecond)
+	close(unblock)
+	if err := <-errs; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	inFlight, _, finished, released, _ := service.stats()
+	if finished != 1 || released != 4 || inFlight != 0 {
+		t.Fatalf("finished %d, released %d, in flight %d, want 1, 4, 0", finished, released, inFlight)
+	}
+}
+
+func TestMediaHandlerShutdownHonorsDeadline(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+	defer close(unblock)
+	service := newFakeMediaService(1, func(*models.InfoForThumbnail) {
+		close(started)
+		<-unblock
+	})
+	mh := New(zerolog.Nop(), service, 1, 1, 1, time.Minute)
+	if err := mh.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := mh.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown error = %v, want DeadlineExceeded", err)
+	}
+}
+
+// Срок подтверждения продлевается, пока задача выполняется
+func TestMediaHandlerExtendsAckWait(t *testing.T) {
+	service := newFakeMediaService(1, func(*models.InfoForThumbnail) {
+		time.Sleep(60 * time.Millisecond)
+	})
+	mh := New(zerolog.Nop(), service, 1, 1, 1, 30*time.Millisecond)
+	if err := mh.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "task", func() bool {
+		_, _, finished, _, _ := service.stats()
+		return finished == 1
+	})
+	if err := mh.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Один раз при старте и хотя бы дважды по таймеру
+	if _, _, _, _, progress := service.stats(); progress < 3 {
+		t.Fatalf("ack wait extended %d times, want at least 3", progress)
+	}
+}
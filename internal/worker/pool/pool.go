@@ -1,6 +1,7 @@
 package pool
 
 import (
+	"context"
 	"sync"
 
 	"github.com/rs/zerolog"
@@ -14,29 +15,40 @@ type Pool struct {
 	wg         sync.WaitGroup
 }
 
-// Выполнение задачи
-func (p *Pool) RunBackground(f func()) {
+// Выполнение задач из канала
+func (p *Pool) RunBackground(jobs <-chan func()) {
 	// Проходимся по всем воркерам
 	for i := 0; i < p.workersNum; i++ {
 		// Создаем воркера
 		worker := NewWorker(p.log)
 		// Добавляем в массив
 		p.workers = append(p.workers, worker)
-		// Устанавливаем конкретную задачу
-		worker.SetTask(f)
-		// Запускаем воркера выполнять эту задачу
-		worker.Start(&p.wg)
+		// Запускаем воркера выполнять задачи из общего канала
+		worker.Start(&p.wg, jobs)
 	}
 }
 
 // Остановка
-func (p *Pool) Stop() {
+// Начатые задачи доделываются, но не дольше, чем позволяет ctx
+func (p *Pool) Stop(ctx context.Context) error {
 	for _, worker := range p.workers {
 		// Останавливаем каждого воркера
 		worker.Stop()
 	}
+
 	// Ждем когда остановятся все воркеры
-	p.wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func New(log zerolog.Logger, workersNum int) *Pool {
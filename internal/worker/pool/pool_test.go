@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Stop дожидается начатых задач, а оставшиеся в канале не запускает
+func TestPoolStopWaitsForRunningJobs(t *testing.T) {
+	jobs := make(chan func(), 2)
+	started, unblock, finished := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	jobs <- func() {
+		close(started)
+		<-unblock
+		close(finished)
+	}
+	p := New(zerolog.Nop(), 1)
+	p.RunBackground(jobs)
+	<-started
+
+	ran := false
+	jobs <- func() { ran = true }
+
+	errs := make(chan error, 1)
+	go func() { errs <- p.Stop(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	close(unblock)
+	if err := <-errs; err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Stop returned before the running job finished")
+	}
+	if ran || len(jobs) != 1 {
+		t.Fatal("queued job started after Stop")
+	}
+}
+
+func TestPoolStopHonorsContext(t *testing.T) {
+	jobs := make(chan func(), 1)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	defer close(unblock)
+	jobs <- func() {
+		close(started)
+		<-unblock
+	}
+	p := New(zerolog.Nop(), 1)
+	p.RunBackground(jobs)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop error = %v, want DeadlineExceeded", err)
+	}
+}
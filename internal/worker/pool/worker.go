@@ -2,7 +2,6 @@ package pool
 
 import (
 	"sync"
-	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -11,27 +10,32 @@ type Worker struct {
 	log zerolog.Logger
 	// Канал с пустой структурой (структура - потому что она самая легкая)
 	quit chan struct{}
-	// Выполняемая задача
-	task func()
 }
 
-// Запускаем воркера выполнять задачу
-func (w *Worker) Start(wg *sync.WaitGroup) {
+// Запускаем воркера выполнять задачи из канала
+func (w *Worker) Start(wg *sync.WaitGroup, jobs <-chan func()) {
+	wg.Add(1)
 	go func() {
-		w.log.Info().Msg("Start")
-		ticker := time.NewTicker(200 * time.Millisecond)
-		defer ticker.Stop()
-
-		wg.Add(1)
 		defer wg.Done()
+		w.log.Info().Msg("Start")
 
 		// Бесконечный цикл
 		for {
 			select {
-			// Каждый цикл тикер отправляет сигнал в канал
-			case <-ticker.C:
-				// И воркер может начать выполнять задачу
-				w.task()
+			// Воркер просыпается, только когда есть задача
+			case job, ok := <-jobs:
+				if !ok {
+					w.log.Info().Msg("Jobs channel closed")
+					return
+				}
+				job()
+				// Остановка важнее следующей задачи
+				select {
+				case <-w.quit:
+					w.log.Info().Msg("Stopped")
+					return
+				default:
+				}
 
 			// Если что-то получили в канал, выходим из бесконечного цикла
 			case <-w.quit:
@@ -42,20 +46,19 @@ func (w *Worker) Start(wg *sync.WaitGroup) {
 	}()
 }
 
-// Устанавливаем конкретную задачу
-func (w *Worker) SetTask(task func()) {
-	w.task = task
-}
-
 // Останавливаем воркера
 func (w *Worker) Stop() {
-	// Записываем в канал пустую структуру
-	w.quit <- struct{}{}
+	// Закрываем канал, повторная остановка не блокируется
+	select {
+	case <-w.quit:
+	default:
+		close(w.quit)
+	}
 }
 
 func NewWorker(log zerolog.Logger) *Worker {
 	return &Worker{
 		log:  log,
-		quit: make(chan struct{}, 1),
+		quit: make(chan struct{}),
 	}
 }